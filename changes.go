@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+const (
+	// AnnotationCommit 工作负载注解，记录最后一次成功部署的 Git 提交
+	AnnotationCommit = "net.guoyk.deployer/commit"
+)
+
+// matchPathGlob 判断文件路径是否匹配 glob 模式，"**" 可以匹配任意多级目录，模式匹配某个上级目录时也视为匹配
+func matchPathGlob(pattern string, name string) bool {
+	pattern = strings.Trim(path.Clean("/"+strings.TrimSpace(pattern)), "/")
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if pattern == "" {
+		return true
+	}
+	return matchPathSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchPathSegments(patterns []string, names []string) bool {
+	if len(patterns) == 0 {
+		// 模式已经匹配完毕，剩余部分位于匹配的目录之下
+		return true
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchPathSegments(patterns[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(patterns[0], names[0]); !ok {
+		return false
+	}
+	return matchPathSegments(patterns[1:], names[1:])
+}
+
+// MatchPaths 返回第一个匹配任意模式的文件
+func MatchPaths(patterns []string, files []string) (string, bool) {
+	for _, file := range files {
+		for _, pattern := range patterns {
+			if matchPathGlob(pattern, file) {
+				return file, true
+			}
+		}
+	}
+	return "", false
+}
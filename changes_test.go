@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMatchPathGlob(t *testing.T) {
+	assert.True(t, matchPathGlob("api", "api/main.go"))
+	assert.True(t, matchPathGlob("api/", "api/pkg/main.go"))
+	assert.True(t, matchPathGlob("api/**/*.go", "api/main.go"))
+	assert.True(t, matchPathGlob("api/**/*.go", "api/pkg/x/main.go"))
+	assert.True(t, matchPathGlob("**/package.json", "web/package.json"))
+	assert.True(t, matchPathGlob("*.yml", "deployer.yml"))
+	assert.False(t, matchPathGlob("api/**/*.go", "api/README.md"))
+	assert.False(t, matchPathGlob("api", "web/api/main.go"))
+	assert.False(t, matchPathGlob("*.yml", "api/deployer.yml"))
+}
+
+func TestMatchPaths(t *testing.T) {
+	file, ok := MatchPaths([]string{"web", "shared/**"}, []string{"api/main.go", "shared/util.go"})
+	assert.True(t, ok)
+	assert.Equal(t, "shared/util.go", file)
+	_, ok = MatchPaths([]string{"web"}, []string{"api/main.go"})
+	assert.False(t, ok)
+}
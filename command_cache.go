@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/acicn/deployer2/pkg/buildcache"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runCacheCommand 子命令 cache，管理构建缓存
+func runCacheCommand(args []string) (err error) {
+	if len(args) == 0 {
+		err = errors.New("用法: deployer2 cache list|prune [参数]")
+		return
+	}
+	var root string
+	if root, err = buildcache.Root(); err != nil {
+		return
+	}
+	switch args[0] {
+	case "list", "ls":
+		err = runCacheList(root, args[1:])
+	case "prune":
+		err = runCachePrune(root, args[1:])
+	default:
+		err = fmt.Errorf("未知的 cache 子命令: %s", args[0])
+	}
+	return
+}
+
+func runCacheList(root string, args []string) (err error) {
+	var optVerbose bool
+	fs := flag.NewFlagSet("cache list", flag.ContinueOnError)
+	fs.BoolVar(&optVerbose, "v", false, "显示每个缓存条目")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	var groups []buildcache.Group
+	if groups, err = buildcache.List(root); err != nil {
+		return
+	}
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "GROUP\tSIZE\tLAST USED\tPATH")
+	for _, group := range groups {
+		total += group.Size
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t\n", group.Name, buildcache.FormatSize(group.Size), group.LastUsed.Format(time.RFC3339))
+		if !optVerbose {
+			continue
+		}
+		for _, entry := range group.Entries {
+			_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", entry.Name, buildcache.FormatSize(entry.Size), entry.Meta.LastUsed.Format(time.RFC3339), entry.Meta.Path)
+		}
+	}
+	_ = w.Flush()
+	log.Printf("缓存目录: %s, 总大小: %s", root, buildcache.FormatSize(total))
+	return
+}
+
+func runCachePrune(root string, args []string) (err error) {
+	var (
+		optGroup   string
+		optMaxAge  time.Duration
+		optMaxSize string
+	)
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	fs.StringVar(&optGroup, "group", "", "只清理指定的缓存组")
+	fs.DurationVar(&optMaxAge, "max-age", 0, "清理超过该时长未使用的缓存，比如 720h")
+	fs.StringVar(&optMaxSize, "max-size", "", "清理最久未使用的缓存，直到总大小不超过该值，比如 20G")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	opts := buildcache.PruneOptions{Group: optGroup, MaxAge: optMaxAge}
+	if optMaxSize != "" {
+		if opts.MaxSize, err = buildcache.ParseSize(optMaxSize); err != nil {
+			return
+		}
+	}
+	if opts.MaxAge == 0 && opts.MaxSize == 0 {
+		err = errors.New("缺少 --max-age 或者 --max-size 参数")
+		return
+	}
+	var removed, skipped []buildcache.Entry
+	if removed, skipped, err = buildcache.Prune(root, opts); err != nil {
+		return
+	}
+	for _, entry := range skipped {
+		log.Printf("跳过正在使用的缓存: %s/%s (%s)", entry.Group, entry.Name, buildcache.FormatSize(entry.Size))
+	}
+	var total int64
+	for _, entry := range removed {
+		total += entry.Size
+		log.Printf("清理缓存: %s/%s (%s), 最后使用于 %s", entry.Group, entry.Name, buildcache.FormatSize(entry.Size), entry.Meta.LastUsed.Format(time.RFC3339))
+	}
+	log.Printf("共清理 %d 个缓存，释放 %s", len(removed), buildcache.FormatSize(total))
+	return
+}
@@ -4,6 +4,16 @@ import "path"
 
 type ImageNames []string
 
+// NewImageNames 根据镜像名、环境名和构建号生成镜像名列表，首个为主镜像名
+func NewImageNames(image, profile, buildNumber string) ImageNames {
+	var out ImageNames
+	if buildNumber != "" {
+		out = append(out, image+":"+profile+"-build-"+buildNumber)
+	}
+	out = append(out, image+":"+profile)
+	return out
+}
+
 func (ims ImageNames) Primary() string {
 	return ims[0]
 }
@@ -5,6 +5,11 @@ import (
 	"testing"
 )
 
+func TestNewImageNames(t *testing.T) {
+	assert.Equal(t, ImageNames{"a:prod-build-12", "a:prod"}, NewImageNames("a", "prod", "12"))
+	assert.Equal(t, ImageNames{"a:prod"}, NewImageNames("a", "prod", ""))
+}
+
 func TestImageNames(t *testing.T) {
 	imageNames := ImageNames{"a", "b"}
 	assert.Equal(t, "a", imageNames.Primary())
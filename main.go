@@ -1,20 +1,44 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"flag"
 	"github.com/acicn/deployer2/pkg/cmds"
 	"github.com/acicn/deployer2/pkg/image_tracker"
+	"github.com/acicn/deployer2/pkg/redact"
 	"github.com/guoyk93/tempfile"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// ExitCodeNoChanges 所有服务的相关路径都没有变化，跳过了构建和部署
+	ExitCodeNoChanges = 3
+	// ExitCodeInterrupted 收到 SIGINT 或者 SIGTERM 信号，取消了执行
+	ExitCodeInterrupted = 130
+
+	// cleanupTimeout 清理镜像的超时时间
+	cleanupTimeout = time.Minute * 5
+)
+
+var (
+	errNoChanges = errors.New("相关路径没有变化，跳过构建和部署")
 )
 
 func exit(err *error) {
-	if *err != nil {
+	if *err == errNoChanges {
+		log.Println("跳过退出:", (*err).Error())
+		os.Exit(ExitCodeNoChanges)
+	} else if errors.Is(*err, context.Canceled) {
+		log.Println("取消退出:", (*err).Error())
+		os.Exit(ExitCodeInterrupted)
+	} else if *err != nil {
 		log.Println("错误退出:", (*err).Error())
 		os.Exit(1)
 	} else {
@@ -27,20 +51,31 @@ func main() {
 	defer exit(&err)
 	defer tempfile.DeleteAll()
 
-	log.SetOutput(os.Stdout)
+	log.SetOutput(redact.NewWriter(os.Stdout))
 	log.SetPrefix("[deployer2] ")
 
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		err = runCacheCommand(os.Args[2:])
+		return
+	}
+
 	var (
 		optManifest      string
 		optImage         string
 		optProfile       string
+		optServices      ServiceNames
+		optAllServices   bool
 		optWorkloads     UniversalWorkloads
 		optCPU           UniversalResource
 		optMEM           UniversalResource
 		optSkipDeploy    bool
 		optIgnoreBuilder bool
+		optForce         bool
+		optReport        string
+		optCreateMissing bool
+		optDryRun        bool
 
-		imageNames   ImageNames
 		imageTracker = image_tracker.New()
 	)
 
@@ -49,6 +84,12 @@ func main() {
 	flag.StringVar(&optProfile, "profile", "", "指定环境名")
 	flag.BoolVar(&optSkipDeploy, "skip-deploy", false, "跳过部署流程")
 	flag.BoolVar(&optIgnoreBuilder, "ignore-builder", false, "don't use builder image")
+	flag.BoolVar(&optForce, "force", false, "忽略 paths 字段，强制构建和部署")
+	flag.StringVar(&optReport, "report", "", "输出运行报告 (JSON 格式) 到指定文件，包含构建步骤耗时和构建产物")
+	flag.BoolVar(&optCreateMissing, "create-missing", false, "工作负载不存在时，根据环境配置自动创建工作负载和 Service")
+	flag.BoolVar(&optDryRun, "dry-run-manifests", false, "只渲染并输出 manifests 字段，不执行构建和部署")
+	flag.Var(&optServices, "service", "指定服务名 (多服务模式)，可以指定多次")
+	flag.BoolVar(&optAllServices, "all-services", false, "处理描述文件中的所有服务 (多服务模式)")
 	flag.Var(&optWorkloads, "workload", "指定目标工作负载，格式为 \"CLUSTER/NAMESPACE/TYPE/NAME[/CONTAINER]\"")
 	flag.Var(&optCPU, "cpu", "指定 CPU 配额，格式为 \"MIN:MAX\"，单位为 m (千分之一核心)")
 	flag.Var(&optMEM, "mem", "指定 MEM 配额，格式为 \"MIN:MAX\"，单位为 Mi (兆字节)")
@@ -81,15 +122,27 @@ func main() {
 	if buildNumber == "" {
 		buildNumber = strings.TrimSpace(os.Getenv("BUILD_NUMBER"))
 	}
-	if buildNumber != "" {
-		imageNames = append(imageNames, optImage+":"+optProfile+"-build-"+buildNumber)
-	}
-	imageNames = append(imageNames, optImage+":"+optProfile)
 
 	log.Println("------------ deployer2 ------------")
 
+	// 收到 SIGINT 或者 SIGTERM 信号时取消执行，终止所有子进程，并照常清理临时文件和镜像，再次收到信号时立即退出
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(chSig)
+	go func() {
+		sig := <-chSig
+		log.Printf("收到信号 %s，取消执行", sig.String())
+		cancel()
+		sig = <-chSig
+		log.Printf("再次收到信号 %s，立即退出", sig.String())
+		tempfile.DeleteAll()
+		os.Exit(ExitCodeInterrupted)
+	}()
+
 	// 打印 Docker 版本
-	_ = cmds.DockerVersion()
+	_ = cmds.DockerVersion(ctx)
 
 	// 加载本地清单文件，即 deployer.yml
 	var manifest Manifest
@@ -98,115 +151,146 @@ func main() {
 		return
 	}
 
-	// 加载本地清单文件中对应的 Profile
-	log.Printf("使用环境: %s", optProfile)
-	var profile Profile
-	if profile, err = manifest.Profile(optProfile); err != nil {
-		return
-	}
-	// 如果命令行指定了 --mem 和 --cpu，覆盖 Profile 文件中的设置
-	if !optCPU.IsZero() {
-		profile.Resource.CPU = &optCPU
-	}
-	if !optMEM.IsZero() {
-		profile.Resource.MEM = &optMEM
-	}
-	var fileBuild, filePackage string
-	if fileBuild, filePackage, err = profile.GenerateFiles(); err != nil {
-		return
-	}
-	log.Printf("写入构建文件: %s", fileBuild)
-	log.Printf("写入打包文件: %s", filePackage)
-
-	// 执行构建脚本
-	if profile.Builder.Image != "" && !optIgnoreBuilder {
-		log.Println("------------ 使用容器构建 ------------")
-		cacheGroup := profile.Builder.CacheGroup
-		if cacheGroup == "" {
-			cacheGroup = "default"
-		}
-		var home string
-		if home, err = os.UserHomeDir(); err != nil {
+	// 确定要处理的服务，单仓库模式下只有一个匿名服务
+	var units []*Unit
+	if len(optServices) == 0 && !optAllServices {
+		log.Printf("使用环境: %s", optProfile)
+		var profile Profile
+		if profile, err = manifest.Profile(optProfile); err != nil {
 			return
 		}
-		if err = cmds.ExecuteInDocker(
-			profile.Builder.Image,
-			filepath.Join(home, ".deployer2-builder-cache", cacheGroup),
-			profile.Builder.Caches,
-			fileBuild,
-		); err != nil {
+		var dir string
+		if dir, err = filepath.Abs("."); err != nil {
 			return
 		}
+		units = append(units, &Unit{
+			Dir:        dir,
+			Profile:    profile,
+			ImageNames: NewImageNames(optImage, optProfile, buildNumber),
+		})
 	} else {
-		log.Println("------------ 构建 ------------")
-		if err = cmds.Execute(fileBuild); err != nil {
+		if len(manifest.Services) == 0 {
+			err = errors.New("描述文件 deployer.yml 中没有配置 services 字段，无法使用多服务模式")
 			return
 		}
-	}
-	log.Println("构建完成")
-
-	// 执行打包脚本，即 docker build
-	log.Println("------------ 打包 ------------")
-	if err = cmds.DockerBuild(filePackage, imageNames.Primary()); err != nil {
-		return
-	}
-	log.Printf("打包完成: %s", imageNames.Primary())
-
-	// 追踪涉及到的所有临时镜像，用来做事后清理
-	imageTracker.Add(imageNames.Primary())
-	defer imageTracker.DeleteAll()
-
-	// 遍历所有 --workload 参数，执行推送/部署流程
-	for _, workload := range optWorkloads {
-		log.Printf("------------ 部署 [%s] ------------", workload.String())
-
-		// 加载集群预置文件
-		var preset Preset
-		if err = LoadPresetFromHome(workload.Cluster, &preset); err != nil {
-			if os.IsNotExist(err) {
-				log.Printf("无法找到集群预置文件 %s, 请确认 --workload 参数是否正确", workload.Cluster)
-			}
-			return
+		services := []string(optServices)
+		if optAllServices {
+			services = manifest.ServiceNames()
 		}
-
-		// 生成 .docker/config.json 和 kubeconfig 文件
-		var dcDir, kcFile string
-		if dcDir, kcFile, err = preset.GenerateFiles(); err != nil {
+		if len(services) > 1 && len(optWorkloads) > 0 {
+			err = errors.New("处理多个服务时不能使用 --workload 参数，请在 deployer.yml 中为每个服务配置 workloads 字段")
 			return
 		}
-
-		// 打印 kubernetes 集群版本
-		_ = cmds.KubectlVersion(kcFile)
-
-		// 使用指定的远程镜像仓库地址
-		remoteImageNames := imageNames.Derive(preset.Registry)
-
-		// 推送镜像到远程仓库
-		for _, remoteImageName := range remoteImageNames {
-			log.Printf("推送镜像: %s", remoteImageName)
-			if err = cmds.DockerTag(imageNames.Primary(), remoteImageName); err != nil {
+		log.Printf("使用环境: %s, 服务: %s", optProfile, strings.Join(services, ", "))
+		for _, service := range services {
+			var profile Profile
+			if profile, err = manifest.ServiceProfile(service, optProfile); err != nil {
 				return
 			}
-			imageTracker.Add(remoteImageName)
-			if err = cmds.DockerPush(remoteImageName, dcDir); err != nil {
+			var dir string
+			if dir, err = filepath.Abs(filepath.Join(filepath.Dir(optManifest), manifest.ServiceContext(service))); err != nil {
 				return
 			}
+			// 服务默认关注其上下文目录
+			if len(profile.Paths) == 0 {
+				profile.Paths = []string{manifest.ServiceContext(service)}
+			}
+			units = append(units, &Unit{
+				Service:    service,
+				Dir:        dir,
+				Profile:    profile,
+				ImageNames: NewImageNames(manifest.ServiceImage(service, optImage), optProfile, buildNumber),
+			})
 		}
+	}
 
-		if optSkipDeploy {
-			continue
+	for _, unit := range units {
+		// 如果命令行指定了 --mem 和 --cpu，覆盖 Profile 文件中的设置
+		if !optCPU.IsZero() {
+			unit.Profile.Resource.CPU = &optCPU
+		}
+		if !optMEM.IsZero() {
+			unit.Profile.Resource.MEM = &optMEM
 		}
+		// 命令行指定的 --workload 优先于 Profile 文件中的 workloads 字段
+		if len(optWorkloads) > 0 {
+			unit.Workloads = optWorkloads
+		} else {
+			unit.Workloads = unit.Profile.Workloads
+		}
+	}
 
-		// 构建工作负载补丁
-		patch := CreateUniversalPatch(&preset, &profile, &workload, remoteImageNames.Primary())
+	// 只渲染并输出 manifests 字段
+	if optDryRun {
+		out := redact.NewLineWriter(os.Stdout)
+		defer out.Flush()
+		for _, unit := range units {
+			if err = PrintManifests(out, unit); err != nil {
+				return
+			}
+		}
+		return
+	}
 
-		// 执行 kubectl patch 命令，更新工作负载
-		var buf []byte
-		if buf, err = json.Marshal(patch); err != nil {
-			return
+	// 追踪涉及到的所有临时镜像，用来做事后清理
+	defer func() {
+		// 即使已经取消，也需要清理镜像
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		imageTracker.DeleteAll(ctx)
+	}()
+
+	runner := &Runner{
+		IgnoreBuilder: optIgnoreBuilder,
+		SkipDeploy:    optSkipDeploy,
+		CreateMissing: optCreateMissing,
+		ImageTracker:  imageTracker,
+	}
+	if optReport != "" {
+		runner.Report = &RunReport{StartedAt: time.Now()}
+		defer func() {
+			if err != nil {
+				runner.Report.Error = err.Error()
+			}
+			if errReport := runner.Report.WriteFile(optReport); errReport != nil {
+				log.Printf("无法写入运行报告 %s: %s", optReport, errReport.Error())
+			}
+		}()
+	}
+	if runner.RepoDir, err = filepath.Abs(filepath.Dir(optManifest)); err != nil {
+		return
+	}
+	// 获取当前 Git 提交，用于记录和对比部署版本
+	if runner.Commit = strings.TrimSpace(os.Getenv("GIT_COMMIT")); runner.Commit == "" {
+		runner.Commit, _ = cmds.GitRevParse(ctx, runner.RepoDir, "HEAD")
+	}
+	if runner.Report != nil {
+		runner.Report.Commit = runner.Commit
+	}
+
+	var count int
+	for _, unit := range units {
+		if !optForce {
+			var changed bool
+			if changed, err = runner.Changed(ctx, unit); err != nil {
+				return
+			}
+			if !changed {
+				if unit.Service != "" {
+					log.Printf("服务 [%s] 的相关路径 (%s) 没有变化，跳过构建和部署", unit.Service, strings.Join(unit.Profile.Paths, ", "))
+				} else {
+					log.Printf("相关路径 (%s) 没有变化，跳过构建和部署", strings.Join(unit.Profile.Paths, ", "))
+				}
+				continue
+			}
 		}
-		if err = cmds.KubectlPatch(kcFile, workload.Namespace, workload.Name, workload.Type, string(buf)); err != nil {
+		if err = runner.Run(ctx, unit); err != nil {
 			return
 		}
+		count++
+	}
+	if count == 0 {
+		err = errNoChanges
+		return
 	}
 }
@@ -2,21 +2,34 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/imdario/mergo"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 const (
 	ManifestVersion = 2
 )
 
-type Manifest struct {
-	Version  int                `yaml:"version"`
+// ManifestService 多服务模式 (Monorepo) 下的单个服务，拥有独立的上下文目录、镜像名和环境配置
+type ManifestService struct {
+	Image    string             `yaml:"image"`
+	Context  string             `yaml:"context"`
 	Default  Profile            `yaml:"default"`
 	Profiles map[string]Profile `yaml:",inline"`
 }
 
+type Manifest struct {
+	Version  int                        `yaml:"version"`
+	Default  Profile                    `yaml:"default"`
+	Services map[string]ManifestService `yaml:"services"`
+	Profiles map[string]Profile         `yaml:",inline"`
+}
+
 func LoadManifest(buf []byte, m *Manifest) (err error) {
 	if err = yaml.UnmarshalStrict(buf, m); err != nil {
 		return
@@ -39,11 +52,92 @@ func LoadManifestFile(file string, m *Manifest) (err error) {
 	return
 }
 
+// profileTransformers 合并环境配置时，需要整体替换而不是逐字段合并的类型
+type profileTransformers struct{}
+
+func (profileTransformers) Transformer(t reflect.Type) func(dst, src reflect.Value) error {
+	switch t {
+	case reflect.TypeOf(&UniversalPreStop{}):
+		// preStop 只能设置一种方式，逐字段合并会同时设置多种
+		return func(dst, src reflect.Value) error { return nil }
+	}
+	return nil
+}
+
+// mergeProfile 使用 src 填充 dst 中未设置的字段
+func mergeProfile(dst *Profile, src Profile) error {
+	return mergo.Merge(dst, src, mergo.WithTransformers(profileTransformers{}))
+}
+
 func (m Manifest) Profile(name string) (p Profile, err error) {
 	p = m.Profiles[name]
 	p.Profile = name
-	if err = mergo.Merge(&p, m.Default); err != nil {
+	if err = mergeProfile(&p, m.Default); err != nil {
 		return
 	}
 	return
 }
+
+// ServiceNames 返回所有服务名，按字母排序
+func (m Manifest) ServiceNames() []string {
+	var names []string
+	for name := range m.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServiceProfile 获取服务的环境配置，缺失的值依次从服务的 default 环境，顶层的同名环境，顶层的 default 环境中获取
+func (m Manifest) ServiceProfile(service string, name string) (p Profile, err error) {
+	s, ok := m.Services[service]
+	if !ok {
+		err = fmt.Errorf("描述文件 deployer.yml 中找不到服务 %s", service)
+		return
+	}
+	p = s.Profiles[name]
+	p.Profile = name
+	if err = mergeProfile(&p, s.Default); err != nil {
+		return
+	}
+	var base Profile
+	if base, err = m.Profile(name); err != nil {
+		return
+	}
+	if err = mergeProfile(&p, base); err != nil {
+		return
+	}
+	return
+}
+
+// ServiceContext 获取服务的上下文目录，默认为服务名
+func (m Manifest) ServiceContext(service string) string {
+	if ctx := m.Services[service].Context; ctx != "" {
+		return ctx
+	}
+	return service
+}
+
+// ServiceImage 获取服务的镜像名，默认为 "IMAGE-SERVICE"
+func (m Manifest) ServiceImage(service string, image string) string {
+	if img := m.Services[service].Image; img != "" {
+		return img
+	}
+	return image + "-" + service
+}
+
+// ServiceNames 命令行参数 --service，可以指定多次
+type ServiceNames []string
+
+func (ss ServiceNames) String() string {
+	return strings.Join(ss, ",")
+}
+
+func (ss *ServiceNames) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return errors.New("服务名不能为空")
+	}
+	*ss = append(*ss, s)
+	return nil
+}
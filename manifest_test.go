@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -56,10 +57,62 @@ func TestLoadManifestFile(t *testing.T) {
 	assert.Equal(t, "200:-", p.Resource.MEM.String())
 	assert.Equal(t, "200:2000", p.Resource.CPU.String())
 	var buf []byte
-	buf, err = p.GenerateBuild()
+	buf, err = p.GenerateBuild(p.Build[0])
 	assert.NoError(t, err)
 	assert.Equal(t, []byte(testManifestBuild), bytes.TrimSpace(buf))
 	buf, err = p.GeneratePackage()
 	assert.NoError(t, err)
 	assert.Equal(t, []byte(testManifestPackage), bytes.TrimSpace(buf))
 }
+
+const (
+	testManifestServices = `
+version: 2
+default:
+  check:
+    path: /hello
+  vars:
+    hello: world
+prod:
+  vars:
+    hello: prod
+services:
+  api:
+    image: hello-api
+    default:
+      check:
+        port: 3000
+      workloads:
+        - k8s-prod/hello/deployment/hello-api
+    prod:
+      vars:
+        name: api
+  web:
+    context: frontend
+`
+)
+
+func TestManifest_ServiceProfile(t *testing.T) {
+	var m Manifest
+	err := LoadManifest([]byte(testManifestServices), &m)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "web"}, m.ServiceNames())
+
+	p, err := m.ServiceProfile("api", "prod")
+	require.NoError(t, err)
+	assert.Equal(t, "prod", p.Profile)
+	assert.Equal(t, 3000, p.Check.Port)
+	assert.Equal(t, "/hello", p.Check.Path)
+	assert.Equal(t, "prod", p.Vars["hello"])
+	assert.Equal(t, "api", p.Vars["name"])
+	require.Len(t, p.Workloads, 1)
+	assert.Equal(t, "hello-api", p.Workloads[0].Name)
+
+	assert.Equal(t, "hello-api", m.ServiceImage("api", "hello"))
+	assert.Equal(t, "hello-web", m.ServiceImage("web", "hello"))
+	assert.Equal(t, "api", m.ServiceContext("api"))
+	assert.Equal(t, "frontend", m.ServiceContext("web"))
+
+	_, err = m.ServiceProfile("worker", "prod")
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package allowproxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allowed 判断主机名是否在白名单中，"*.example.com" 匹配所有子域名，其他模式需要完全相等
+func Allowed(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if pattern == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Proxy 只允许访问白名单主机的 HTTP 代理，支持 CONNECT 方法 (HTTPS)
+type Proxy struct {
+	allow     []string
+	listener  net.Listener
+	server    *http.Server
+	transport *http.Transport
+	wg        sync.WaitGroup
+
+	// conns 劫持的 CONNECT 连接，http.Server.Close 不会关闭这些连接
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// Start 在指定地址启动代理
+func Start(addr string, allow []string) (p *Proxy, err error) {
+	p = &Proxy{
+		allow:     allow,
+		transport: &http.Transport{Proxy: nil},
+	}
+	if p.listener, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+	p.server = &http.Server{Handler: p}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		_ = p.server.Serve(p.listener)
+	}()
+	return
+}
+
+// Addr 返回代理实际监听的地址
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Close 关闭代理，同时关闭所有 CONNECT 隧道
+func (p *Proxy) Close() error {
+	err := p.server.Close()
+	p.mutex.Lock()
+	p.closed = true
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mutex.Unlock()
+	p.wg.Wait()
+	p.transport.CloseIdleConnections()
+	return err
+}
+
+// track 记录 CONNECT 隧道的两端连接，代理已经关闭时返回 false，隧道结束后需要调用 untrack
+func (p *Proxy) track(conns ...net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = map[net.Conn]struct{}{}
+	}
+	for _, conn := range conns {
+		p.conns[conn] = struct{}{}
+	}
+	p.wg.Add(1)
+	return true
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range conns {
+		delete(p.conns, conn)
+	}
+	p.wg.Done()
+}
+
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if req.Method != http.MethodConnect && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	if !Allowed(p.allow, host) {
+		log.Printf("网络白名单: 拒绝访问 %s", host)
+		http.Error(rw, "deployer2: host not in allowlist", http.StatusForbidden)
+		return
+	}
+	if req.Method == http.MethodConnect {
+		p.serveConnect(rw, req)
+	} else {
+		p.serveForward(rw, req)
+	}
+}
+
+func (p *Proxy) serveConnect(rw http.ResponseWriter, req *http.Request) {
+	upstream, err := net.DialTimeout("tcp", req.Host, time.Second*30)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		_ = upstream.Close()
+		http.Error(rw, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		_ = upstream.Close()
+		return
+	}
+	if !p.track(conn, upstream) {
+		_ = conn.Close()
+		_ = upstream.Close()
+		return
+	}
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	go func() {
+		defer p.untrack(conn, upstream)
+		done := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+			close(done)
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+		<-done
+	}()
+}
+
+func (p *Proxy) serveForward(rw http.ResponseWriter, req *http.Request) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	res, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	for k, vs := range res.Header {
+		for _, v := range vs {
+			rw.Header().Add(k, v)
+		}
+	}
+	rw.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(rw, res.Body)
+}
@@ -0,0 +1,109 @@
+package allowproxy
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	patterns := []string{"registry.npmjs.org", "*.maven.org"}
+	assert.True(t, Allowed(patterns, "registry.npmjs.org"))
+	assert.True(t, Allowed(patterns, "registry.npmjs.org:443"))
+	assert.True(t, Allowed(patterns, "repo1.maven.org"))
+	assert.False(t, Allowed(patterns, "maven.org"))
+	assert.False(t, Allowed(patterns, "npmjs.org"))
+	assert.False(t, Allowed(patterns, "evil.com"))
+}
+
+func TestProxy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	defer s.Close()
+	target, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	p, err := Start("127.0.0.1:0", []string{target.Hostname()})
+	require.NoError(t, err)
+	defer p.Close()
+
+	proxyURL, err := url.Parse("http://" + p.Addr())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	res, err := client.Get(s.URL)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello", string(buf))
+
+	res, err = client.Get("http://denied.example.com/")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestProxy_CloseConnect(t *testing.T) {
+	// 上游服务只回显数据，不主动关闭连接
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	p, err := Start("127.0.0.1:0", []string{"127.0.0.1"})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", p.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("CONNECT " + l.Addr().String() + " HTTP/1.1\r\nHost: " + l.Addr().String() + "\r\n\r\n"))
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// 关闭代理时关闭隧道
+	closed := make(chan error, 1)
+	go func() {
+		closed <- p.Close()
+	}()
+	select {
+	case err = <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("关闭代理超时")
+	}
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
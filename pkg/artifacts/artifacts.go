@@ -0,0 +1,249 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// headSize 判断产物类型时读取的文件开头大小
+	headSize = 4096
+)
+
+const (
+	KindJUnit    = "junit"
+	KindCoverage = "coverage"
+	KindFile     = "file"
+)
+
+// JUnitSummary JUnit XML 测试报告的统计
+type JUnitSummary struct {
+	Tests    int `json:"tests"`
+	Failures int `json:"failures"`
+	Errors   int `json:"errors"`
+	Skipped  int `json:"skipped"`
+}
+
+// Artifact 收集到的构建产物，Path 为相对于工作目录的路径
+type Artifact struct {
+	Path   string        `json:"path"`
+	Kind   string        `json:"kind"`
+	Size   int64         `json:"size"`
+	SHA256 string        `json:"sha256"`
+	JUnit  *JUnitSummary `json:"junit,omitempty"`
+}
+
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func matchSegments(patterns []string, names []string) bool {
+	if len(patterns) == 0 {
+		return len(names) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(patterns[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(patterns[0], names[0]); !ok {
+		return false
+	}
+	return matchSegments(patterns[1:], names[1:])
+}
+
+// Match 判断相对路径是否匹配 glob 模式，"**" 可以匹配任意多级目录
+func Match(pattern string, name string) bool {
+	pattern = strings.Trim(path.Clean("/"+strings.TrimSpace(pattern)), "/")
+	name = strings.Trim(path.Clean("/"+name), "/")
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// Glob 在目录中查找匹配模式的文件，返回排序后的相对路径，只从模式中第一个通配符之前的目录开始遍历
+func Glob(dir string, pattern string) (names []string, err error) {
+	clean := strings.Trim(path.Clean("/"+strings.TrimSpace(pattern)), "/")
+	if clean == "" {
+		return
+	}
+	var base []string
+	for _, seg := range strings.Split(clean, "/") {
+		if hasMeta(seg) {
+			break
+		}
+		base = append(base, seg)
+	}
+	root := filepath.Join(dir, filepath.FromSlash(strings.Join(base, "/")))
+	if _, err = os.Stat(root); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if Match(clean, rel) {
+			names = append(names, rel)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	sort.Strings(names)
+	return
+}
+
+// DetectKind 根据文件名和内容判断产物类型
+func DetectKind(name string, head []byte) string {
+	base := strings.ToLower(path.Base(name))
+	switch {
+	case strings.HasSuffix(base, ".xml") && (strings.Contains(string(head), "<testsuite")):
+		return KindJUnit
+	case strings.HasPrefix(base, "coverage") || strings.HasPrefix(base, "lcov") ||
+		strings.HasPrefix(base, "cobertura") || strings.HasPrefix(base, "jacoco") ||
+		strings.HasSuffix(base, ".lcov") || strings.HasSuffix(base, ".coverprofile"):
+		return KindCoverage
+	}
+	return KindFile
+}
+
+type junitSuite struct {
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+func (s junitSuite) sum(out *JUnitSummary) {
+	if len(s.Suites) > 0 {
+		for _, sub := range s.Suites {
+			sub.sum(out)
+		}
+		return
+	}
+	out.Tests += s.Tests
+	out.Failures += s.Failures
+	out.Errors += s.Errors
+	out.Skipped += s.Skipped
+}
+
+// ParseJUnit 统计 JUnit XML 测试报告，支持 <testsuites> 和 <testsuite> 根元素
+func ParseJUnit(buf []byte) (out JUnitSummary, err error) {
+	var root junitSuite
+	if err = xml.Unmarshal(buf, &root); err != nil {
+		return
+	}
+	root.sum(&out)
+	return
+}
+
+// readHead 读取文件开头最多 n 个字节，用于判断产物类型
+func readHead(file string, n int64) (head []byte, err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+	head, err = ioutil.ReadAll(io.LimitReader(f, n))
+	return
+}
+
+func copyFile(src, dst string) (size int64, sum string, err error) {
+	var in *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+	var out *os.File
+	if out, err = os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	h := sha256.New()
+	if size, err = io.Copy(io.MultiWriter(out, h), in); err != nil {
+		_ = out.Close()
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// Collect 将工作目录中匹配模式的文件复制到输出目录 root/version 中，保留相对路径，root 中已有的文件不会被收集
+func Collect(dir string, patterns []string, root string, version string) (out []Artifact, err error) {
+	outDir := filepath.Join(root, version)
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		var names []string
+		if names, err = Glob(dir, pattern); err != nil {
+			return
+		}
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			src := filepath.Join(dir, filepath.FromSlash(name))
+			dst := filepath.Join(outDir, filepath.FromSlash(name))
+			// 输出目录位于工作目录中时，避免收集之前的产物
+			if rel, _ := filepath.Rel(root, src); rel != "" && !strings.HasPrefix(rel, "..") {
+				continue
+			}
+			a := Artifact{Path: name}
+			if a.Size, a.SHA256, err = copyFile(src, dst); err != nil {
+				err = fmt.Errorf("无法收集构建产物 %s: %s", name, err.Error())
+				return
+			}
+			var head []byte
+			if head, err = readHead(dst, headSize); err != nil {
+				return
+			}
+			if a.Kind = DetectKind(name, head); a.Kind == KindJUnit {
+				// 无法解析的测试报告仍然作为构建产物保留，不中断构建
+				var buf []byte
+				if buf, err = ioutil.ReadFile(dst); err != nil {
+					return
+				}
+				var s JUnitSummary
+				if s, err = ParseJUnit(buf); err != nil {
+					log.Printf("警告: 无法解析 JUnit 测试报告 %s: %s", name, err.Error())
+					err = nil
+				} else {
+					a.JUnit = &s
+				}
+			}
+			out = append(out, a)
+		}
+	}
+	return
+}
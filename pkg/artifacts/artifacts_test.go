@@ -0,0 +1,94 @@
+package artifacts
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		ok      bool
+	}{
+		{"coverage.out", "coverage.out", true},
+		{"target/surefire-reports/*.xml", "target/surefire-reports/TEST-a.xml", true},
+		{"target/surefire-reports/*.xml", "target/surefire-reports/sub/TEST-a.xml", false},
+		{"**/junit.xml", "junit.xml", true},
+		{"**/junit.xml", "a/b/junit.xml", true},
+		{"build/**", "build/a/b", true},
+		{"build", "build/a", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.ok, Match(c.pattern, c.name), "Match(%q, %q)", c.pattern, c.name)
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	require.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+}
+
+func TestCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer2-artifacts-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "reports", "a", "junit.xml"), `<?xml version="1.0"?>
+<testsuites>
+  <testsuite name="a" tests="3" failures="1" errors="0" skipped="1"></testsuite>
+  <testsuite name="b" tests="2" failures="0" errors="1"></testsuite>
+</testsuites>`)
+	writeFile(t, filepath.Join(dir, "coverage.out"), "mode: set\n")
+	writeFile(t, filepath.Join(dir, "bin", "app"), "binary")
+	writeFile(t, filepath.Join(dir, "src", "main.go"), "package main")
+
+	writeFile(t, filepath.Join(dir, "deployer2-artifacts", "test-build-1", "reports", "old.xml"), "<testsuite/>")
+
+	root := filepath.Join(dir, "deployer2-artifacts")
+	out := filepath.Join(root, "test-build-2")
+	arts, err := Collect(dir, []string{"**/*.xml", "coverage.out", "bin/*", "coverage.out", "deployer2-artifacts/**"}, root, "test-build-2")
+	require.NoError(t, err)
+	require.Len(t, arts, 3)
+	assert.Equal(t, "reports/a/junit.xml", arts[0].Path)
+	assert.Equal(t, KindJUnit, arts[0].Kind)
+	require.NotNil(t, arts[0].JUnit)
+	assert.Equal(t, JUnitSummary{Tests: 5, Failures: 1, Errors: 1, Skipped: 1}, *arts[0].JUnit)
+	assert.Equal(t, "coverage.out", arts[1].Path)
+	assert.Equal(t, KindCoverage, arts[1].Kind)
+	assert.Equal(t, "bin/app", arts[2].Path)
+	assert.Equal(t, KindFile, arts[2].Kind)
+	assert.Equal(t, int64(6), arts[2].Size)
+	assert.NotEmpty(t, arts[2].SHA256)
+	buf, err := ioutil.ReadFile(filepath.Join(out, "bin", "app"))
+	require.NoError(t, err)
+	assert.Equal(t, "binary", string(buf))
+}
+
+func TestCollect_MalformedJUnit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer2-artifacts-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 无法解析的测试报告仍然被收集，但没有统计
+	writeFile(t, filepath.Join(dir, "reports", "junit.xml"), `<testsuite tests="1"><testcase>`)
+	root := filepath.Join(dir, "deployer2-artifacts")
+	arts, err := Collect(dir, []string{"reports/*.xml"}, root, "test-build-1")
+	require.NoError(t, err)
+	require.Len(t, arts, 1)
+	assert.Equal(t, KindJUnit, arts[0].Kind)
+	assert.Nil(t, arts[0].JUnit)
+	_, err = os.Stat(filepath.Join(root, "test-build-1", "reports", "junit.xml"))
+	assert.NoError(t, err)
+}
+
+func TestParseJUnit_SingleSuite(t *testing.T) {
+	s, err := ParseJUnit([]byte(`<testsuite tests="4" failures="2"></testsuite>`))
+	require.NoError(t, err)
+	assert.Equal(t, 4, s.Tests)
+	assert.Equal(t, 2, s.Failures)
+}
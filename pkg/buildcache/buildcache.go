@@ -0,0 +1,283 @@
+package buildcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MetaSuffix 缓存条目元数据文件的后缀，元数据文件与缓存条目目录位于同一级
+	MetaSuffix = ".deployer2-meta.json"
+)
+
+// Root 构建缓存根目录，即 $HOME/.deployer2-builder-cache
+func Root() (dir string, err error) {
+	var home string
+	if home, err = os.UserHomeDir(); err != nil {
+		return
+	}
+	dir = filepath.Join(home, ".deployer2-builder-cache")
+	return
+}
+
+// Meta 缓存条目的元数据
+type Meta struct {
+	Path     string    `json:"path"`
+	LastUsed time.Time `json:"lastUsed"`
+	Uses     int       `json:"uses"`
+	// RemoteKey 缓存条目对应的远程缓存键，即最后一次从远程缓存恢复或者上传到远程缓存的键
+	RemoteKey string `json:"remoteKey,omitempty"`
+}
+
+// Entry 缓存条目，对应缓存组下的一个子目录
+type Entry struct {
+	Group string
+	Name  string
+	Dir   string
+	Size  int64
+	Meta  Meta
+}
+
+// Group 缓存组
+type Group struct {
+	Name     string
+	Size     int64
+	LastUsed time.Time
+	Entries  []Entry
+}
+
+func metaFile(dir string) string {
+	return strings.TrimSuffix(dir, string(filepath.Separator)) + MetaSuffix
+}
+
+// ReadMeta 读取缓存条目的元数据，元数据不存在时返回零值
+func ReadMeta(dir string) (m Meta) {
+	if buf, err := ioutil.ReadFile(metaFile(dir)); err == nil {
+		_ = json.Unmarshal(buf, &m)
+	}
+	return
+}
+
+func writeMeta(dir string, m Meta) (err error) {
+	file := metaFile(dir)
+	var buf []byte
+	if buf, err = json.Marshal(m); err != nil {
+		return
+	}
+	// 先写入临时文件再重命名，避免并发读取到不完整的内容
+	tmp := fmt.Sprintf("%s.%d.tmp", file, os.Getpid())
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return
+	}
+	err = os.Rename(tmp, file)
+	return
+}
+
+// Touch 记录缓存条目的使用，path 为容器内路径
+func Touch(dir string, path string) error {
+	m := ReadMeta(dir)
+	m.Path = path
+	m.LastUsed = time.Now()
+	m.Uses++
+	return writeMeta(dir, m)
+}
+
+// SetRemoteKey 记录缓存条目对应的远程缓存键
+func SetRemoteKey(dir string, key string) error {
+	m := ReadMeta(dir)
+	m.RemoteKey = key
+	return writeMeta(dir, m)
+}
+
+// DirSize 计算目录占用的空间，不跟随符号链接
+func DirSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// List 列出所有缓存组及其缓存条目，缓存条目按最后使用时间排序，最近使用的在前
+func List(root string) (groups []Group, err error) {
+	var groupInfos []os.FileInfo
+	if groupInfos, err = ioutil.ReadDir(root); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, groupInfo := range groupInfos {
+		if !groupInfo.IsDir() {
+			continue
+		}
+		group := Group{Name: groupInfo.Name()}
+		groupDir := filepath.Join(root, group.Name)
+		var entryInfos []os.FileInfo
+		if entryInfos, err = ioutil.ReadDir(groupDir); err != nil {
+			return
+		}
+		for _, entryInfo := range entryInfos {
+			if !entryInfo.IsDir() {
+				continue
+			}
+			entry := Entry{
+				Group: group.Name,
+				Name:  entryInfo.Name(),
+				Dir:   filepath.Join(groupDir, entryInfo.Name()),
+			}
+			entry.Meta = ReadMeta(entry.Dir)
+			// 没有元数据的缓存条目，使用目录的修改时间
+			if entry.Meta.LastUsed.IsZero() {
+				entry.Meta.LastUsed = entryInfo.ModTime()
+			}
+			if entry.Size, err = DirSize(entry.Dir); err != nil {
+				return
+			}
+			group.Size += entry.Size
+			if entry.Meta.LastUsed.After(group.LastUsed) {
+				group.LastUsed = entry.Meta.LastUsed
+			}
+			group.Entries = append(group.Entries, entry)
+		}
+		sort.Slice(group.Entries, func(i, j int) bool {
+			return group.Entries[i].Meta.LastUsed.After(group.Entries[j].Meta.LastUsed)
+		})
+		groups = append(groups, group)
+	}
+	return
+}
+
+// Remove 在排他锁保护下删除缓存条目及其元数据和锁文件，缓存条目正在被使用时不等待，返回 ErrLocked
+func Remove(entry Entry) (err error) {
+	var unlock func()
+	if unlock, err = TryLock(entry.Dir, false); err != nil {
+		return
+	}
+	defer unlock()
+	if err = os.RemoveAll(entry.Dir); err != nil {
+		return
+	}
+	if err = os.Remove(metaFile(entry.Dir)); err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	// 持有锁时删除锁文件，等待该锁文件的其他进程加锁后会发现锁文件已经被删除，并重新创建
+	_ = os.Remove(lockFile(entry.Dir))
+	return
+}
+
+// PruneOptions 清理条件，零值代表不限制
+type PruneOptions struct {
+	// Group 只清理指定的缓存组
+	Group string
+	// MaxAge 清理超过该时长未使用的缓存条目
+	MaxAge time.Duration
+	// MaxSize 清理最久未使用的缓存条目，直到总大小不超过该值
+	MaxSize int64
+}
+
+// Prune 按条件清理缓存条目，返回被清理的缓存条目，以及正在被使用而跳过的缓存条目
+func Prune(root string, opts PruneOptions) (removed []Entry, skipped []Entry, err error) {
+	var groups []Group
+	if groups, err = List(root); err != nil {
+		return
+	}
+	var entries []Entry
+	for _, group := range groups {
+		if opts.Group != "" && opts.Group != group.Name {
+			continue
+		}
+		entries = append(entries, group.Entries...)
+	}
+	// 最久未使用的在前
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Meta.LastUsed.Before(entries[j].Meta.LastUsed)
+	})
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		expired := opts.MaxAge > 0 && now.Sub(entry.Meta.LastUsed) > opts.MaxAge
+		oversize := opts.MaxSize > 0 && total > opts.MaxSize
+		if !expired && !oversize {
+			continue
+		}
+		if err = Remove(entry); err != nil {
+			if err == ErrLocked {
+				err = nil
+				skipped = append(skipped, entry)
+				continue
+			}
+			return
+		}
+		total -= entry.Size
+		removed = append(removed, entry)
+	}
+	return
+}
+
+var (
+	sizeUnits = []struct {
+		suffix string
+		size   int64
+	}{
+		{"T", 1 << 40},
+		{"G", 1 << 30},
+		{"M", 1 << 20},
+		{"K", 1 << 10},
+		{"B", 1},
+	}
+)
+
+// ParseSize 解析大小，支持 K, M, G, T 单位 (1024 进制)，不带单位时为字节
+func ParseSize(s string) (size int64, err error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	if s == "" {
+		err = errors.New("大小格式不正确")
+		return
+	}
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			unit = u.size
+			s = strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+	var v float64
+	if v, err = strconv.ParseFloat(s, 64); err != nil {
+		err = fmt.Errorf("大小格式不正确: %s", s)
+		return
+	}
+	size = int64(v * float64(unit))
+	return
+}
+
+// FormatSize 格式化大小
+func FormatSize(size int64) string {
+	for _, u := range sizeUnits {
+		if size >= u.size && u.size > 1 {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(u.size), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
@@ -0,0 +1,126 @@
+package buildcache
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// createTestEntry 创建缓存条目，并在元数据中记录最后使用时间 lastUsed
+func createTestEntry(t *testing.T, root, group, name string, size int, lastUsed time.Time) string {
+	dir := filepath.Join(root, group, name)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data"), make([]byte, size), 0644))
+	require.NoError(t, writeMeta(dir, Meta{Path: "/root/" + name, LastUsed: lastUsed, Uses: 1}))
+	return dir
+}
+
+func TestTouchAndList(t *testing.T) {
+	root, err := ioutil.TempDir("", "deployer2-buildcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	dir := createTestEntry(t, root, "biz", "root-npm", 100, time.Now().Add(-time.Hour))
+	require.NoError(t, Touch(dir, "/root/.npm"))
+	createTestEntry(t, root, "biz", "root-m2", 50, time.Now().Add(time.Minute))
+
+	groups, err := List(root)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, "biz", groups[0].Name)
+	assert.Equal(t, int64(150), groups[0].Size)
+	require.Len(t, groups[0].Entries, 2)
+	assert.Equal(t, "root-m2", groups[0].Entries[0].Name)
+	assert.Equal(t, "root-npm", groups[0].Entries[1].Name)
+	assert.Equal(t, "/root/.npm", groups[0].Entries[1].Meta.Path)
+	assert.Equal(t, 2, groups[0].Entries[1].Meta.Uses)
+}
+
+func TestPrune(t *testing.T) {
+	root, err := ioutil.TempDir("", "deployer2-buildcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	old := createTestEntry(t, root, "biz", "old", 10, time.Now().Add(-time.Hour*24*30))
+	createTestEntry(t, root, "biz", "lru", 100, time.Now().Add(-time.Hour))
+	createTestEntry(t, root, "biz", "recent", 100, time.Now())
+	createTestEntry(t, root, "other", "recent", 100, time.Now())
+
+	removed, _, err := Prune(root, PruneOptions{Group: "biz", MaxAge: time.Hour * 24 * 7})
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "old", removed[0].Name)
+	_, err = os.Stat(old + MetaSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	removed, _, err = Prune(root, PruneOptions{MaxSize: 200})
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "lru", removed[0].Name)
+
+	groups, err := List(root)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Len(t, groups[0].Entries, 1)
+	assert.Len(t, groups[1].Entries, 1)
+}
+
+func TestPrune_Locked(t *testing.T) {
+	root, err := ioutil.TempDir("", "deployer2-buildcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	busy := createTestEntry(t, root, "biz", "busy", 10, time.Now())
+	idle := createTestEntry(t, root, "biz", "idle", 10, time.Now())
+	unlockIdle, err := Lock(context.Background(), idle, true, time.Second)
+	require.NoError(t, err)
+	unlockIdle()
+
+	// 正在被构建使用的缓存条目不会被清理
+	unlock, err := Lock(context.Background(), busy, true, time.Second)
+	require.NoError(t, err)
+	removed, skipped, err := Prune(root, PruneOptions{MaxSize: 1})
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "idle", removed[0].Name)
+	require.Len(t, skipped, 1)
+	assert.Equal(t, "busy", skipped[0].Name)
+	_, err = os.Stat(busy)
+	assert.NoError(t, err)
+	// 锁文件随缓存条目一起删除
+	_, err = os.Stat(idle + LockSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// 释放锁之后可以清理
+	unlock()
+	removed, skipped, err = Prune(root, PruneOptions{MaxSize: 1})
+	require.NoError(t, err)
+	assert.Len(t, removed, 1)
+	assert.Empty(t, skipped)
+	_, err = os.Stat(busy + LockSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestParseSize(t *testing.T) {
+	for s, v := range map[string]int64{
+		"1024":  1024,
+		"10K":   10 << 10,
+		"512MB": 512 << 20,
+		"10G":   10 << 30,
+		"1.5g":  3 << 29,
+		"2GiB":  2 << 30,
+	} {
+		size, err := ParseSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, v, size, s)
+	}
+	_, err := ParseSize("abc")
+	assert.Error(t, err)
+	assert.Equal(t, "1.5G", FormatSize(3<<29))
+	assert.Equal(t, "100B", FormatSize(100))
+}
@@ -0,0 +1,195 @@
+package buildcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// LockSuffix 缓存条目锁文件的后缀，锁文件与缓存条目目录位于同一级
+	LockSuffix = ".deployer2-lock"
+
+	LockExclusive = "exclusive"
+	LockShared    = "shared"
+	LockNone      = "none"
+	LockSnapshot  = "snapshot"
+
+	// DefaultLockTimeout 默认的锁等待时间
+	DefaultLockTimeout = time.Minute * 30
+
+	lockPollInterval = time.Millisecond * 500
+)
+
+// ValidateLockMode 检查锁模式，空值视为 exclusive
+func ValidateLockMode(mode string) error {
+	switch mode {
+	case "", LockExclusive, LockShared, LockNone, LockSnapshot:
+		return nil
+	}
+	return fmt.Errorf("不支持的缓存锁模式: %s", mode)
+}
+
+var (
+	// ErrLocked 缓存条目正在被使用
+	ErrLocked = errors.New("缓存条目正在被使用")
+)
+
+func lockFile(dir string) string {
+	return strings.TrimSuffix(dir, string(filepath.Separator)) + LockSuffix
+}
+
+// acquire 尝试加锁一次，不等待，加锁成功时返回已经加锁的锁文件
+func acquire(dir string, shared bool) (f *os.File, err error) {
+	for {
+		if f, err = os.OpenFile(lockFile(dir), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+			return
+		}
+		var ok bool
+		if ok, err = tryLock(f, shared); err != nil || !ok {
+			_ = f.Close()
+			f = nil
+			return
+		}
+		// 锁文件可能在打开之后，加锁之前被清理缓存时删除，此时持有的锁已经无效，需要重新打开
+		var fi, pi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			pi, err = os.Stat(lockFile(dir))
+		}
+		if err == nil && os.SameFile(fi, pi) {
+			return
+		}
+		_ = unlockFile(f)
+		_ = f.Close()
+		f = nil
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+}
+
+func releaser(f *os.File) func() {
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+	}
+}
+
+// TryLock 对缓存条目加锁，不等待，缓存条目正在被使用时返回 ErrLocked
+func TryLock(dir string, shared bool) (unlock func(), err error) {
+	var f *os.File
+	if f, err = acquire(dir, shared); err != nil {
+		return
+	}
+	if f == nil {
+		err = ErrLocked
+		return
+	}
+	unlock = releaser(f)
+	return
+}
+
+// Lock 对缓存条目加锁，在超时或者 ctx 取消之前会一直等待，返回解锁函数
+func Lock(ctx context.Context, dir string, shared bool, timeout time.Duration) (unlock func(), err error) {
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		if unlock, err = TryLock(dir, shared); err != ErrLocked {
+			return
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("等待缓存锁超时 (%s): %s", timeout, dir)
+			return
+		}
+		if !waiting {
+			waiting = true
+			log.Printf("等待缓存锁: %s", dir)
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// Snapshot 在共享锁保护下复制缓存条目到临时目录，返回临时目录和清理函数，对快照的修改不会写回缓存
+func Snapshot(ctx context.Context, dir string, timeout time.Duration) (snapshot string, cleanup func(), err error) {
+	var unlock func()
+	if unlock, err = Lock(ctx, dir, true, timeout); err != nil {
+		return
+	}
+	defer unlock()
+	return SnapshotLocked(dir)
+}
+
+// SnapshotLocked 复制缓存条目到临时目录，调用方需要持有缓存条目的锁
+func SnapshotLocked(dir string) (snapshot string, cleanup func(), err error) {
+	if snapshot, err = ioutil.TempDir("", "deployer2-cache-snapshot"); err != nil {
+		return
+	}
+	if err = CopyDir(dir, snapshot); err != nil {
+		_ = os.RemoveAll(snapshot)
+		return
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(snapshot)
+	}
+	return
+}
+
+// CopyDir 递归复制目录，保留文件权限和符号链接
+func CopyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var rel string
+		if rel, err = filepath.Rel(src, path); err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		// 忽略 socket, 管道等特殊文件
+		return nil
+	})
+}
+
+func copyFile(src string, dst string, mode os.FileMode) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode); err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return
+	}
+	err = out.Close()
+	return
+}
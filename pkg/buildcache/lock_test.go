@@ -0,0 +1,101 @@
+package buildcache
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	root, err := ioutil.TempDir("", "deployer2-buildcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "root-npm")
+
+	unlock1, err := Lock(context.Background(), dir, true, time.Second)
+	require.NoError(t, err)
+	unlock2, err := Lock(context.Background(), dir, true, time.Second)
+	require.NoError(t, err)
+
+	_, err = Lock(context.Background(), dir, false, time.Millisecond*100)
+	assert.Error(t, err)
+
+	unlock1()
+	unlock2()
+
+	unlock3, err := Lock(context.Background(), dir, false, time.Second)
+	require.NoError(t, err)
+	_, err = Lock(context.Background(), dir, true, time.Millisecond*100)
+	assert.Error(t, err)
+	unlock3()
+}
+
+func TestTryLock_Removed(t *testing.T) {
+	root, err := ioutil.TempDir("", "deployer2-buildcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "root-npm")
+
+	unlock, err := TryLock(dir, false)
+	require.NoError(t, err)
+	_, err = TryLock(dir, true)
+	assert.Equal(t, ErrLocked, err)
+
+	// 持有锁时锁文件被删除，之后的加锁使用新的锁文件
+	require.NoError(t, os.Remove(dir+LockSuffix))
+	unlock()
+	unlock, err = TryLock(dir, false)
+	require.NoError(t, err)
+	_, err = os.Stat(dir + LockSuffix)
+	assert.NoError(t, err)
+	unlock()
+}
+
+func TestLock_Cancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "deployer2-buildcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "root-npm")
+
+	unlock, err := Lock(context.Background(), dir, false, time.Second)
+	require.NoError(t, err)
+	defer unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Lock(ctx, dir, false, time.Minute)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	root, err := ioutil.TempDir("", "deployer2-buildcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "root-npm")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "data"), []byte("hello"), 0600))
+	require.NoError(t, os.Symlink("sub/data", filepath.Join(dir, "link")))
+
+	snapshot, cleanup, err := Snapshot(context.Background(), dir, time.Second)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadFile(filepath.Join(snapshot, "sub", "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	link, err := os.Readlink(filepath.Join(snapshot, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "sub/data", link)
+
+	// 快照期间不持有锁
+	unlock, err := Lock(context.Background(), dir, false, time.Millisecond*100)
+	require.NoError(t, err)
+	unlock()
+
+	cleanup()
+	_, err = os.Stat(snapshot)
+	assert.True(t, os.IsNotExist(err))
+}
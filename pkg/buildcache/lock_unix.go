@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package buildcache
+
+import (
+	"os"
+	"syscall"
+)
+
+func tryLock(f *os.File, shared bool) (ok bool, err error) {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			err = nil
+		}
+		return
+	}
+	ok = true
+	return
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
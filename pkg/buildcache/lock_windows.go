@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package buildcache
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	warnNoLockOnce sync.Once
+)
+
+// Windows 下不支持 flock，缓存锁不提供任何互斥，总是视为加锁成功，并打印一次警告
+func tryLock(f *os.File, shared bool) (ok bool, err error) {
+	warnNoLockOnce.Do(func() {
+		log.Printf("警告: Windows 下不支持缓存锁，并发构建和缓存清理可能损坏构建缓存")
+	})
+	ok = true
+	return
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
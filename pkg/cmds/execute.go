@@ -2,20 +2,30 @@ package cmds
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/acicn/deployer2/pkg/buildcache"
+	"github.com/acicn/deployer2/pkg/redact"
+	"io"
 	"log"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	KubectlPatchRetries = 3
+	// KillGracePeriod 取消命令时，发送 SIGTERM 之后等待进程组退出的时间，超时则发送 SIGKILL
+	KillGracePeriod = time.Second * 10
+	// CleanupTimeout 取消之后执行清理命令 (比如删除构建容器) 的超时时间
+	CleanupTimeout = time.Second * 30
 
 	InDockerWorkspace = "/workspace"
 	InDockerScript    = "/deployer2-in-docker-script.sh"
@@ -33,112 +43,505 @@ func sanitizePathToPathComponent(path string) string {
 	return regexpNonAlphaNumeric.ReplaceAllString(path, "-") + "-" + hex.EncodeToString(digest[:])
 }
 
-func Execute(name string, args ...string) (err error) {
-	log.Printf("执行: %s %s", name, strings.Join(args, " "))
-	cmd := exec.Command(name, args...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	err = cmd.Run()
-	if ee, ok := err.(*exec.ExitError); ok {
-		log.Printf("执行完成: 返回值(%d)", ee.ExitCode())
+// run 使用全局执行器执行命令，未指定 Stdout 和 Stderr 时，输出到经过脱敏处理的标准输出和标准错误
+func run(ctx context.Context, c Command) (err error) {
+	log.Printf("执行: %s", c.String())
+	if c.Stdout == nil {
+		stdout := redact.NewLineWriter(os.Stdout)
+		defer stdout.Flush()
+		c.Stdout = stdout
+	}
+	if c.Stderr == nil {
+		stderr := redact.NewLineWriter(os.Stderr)
+		defer stderr.Flush()
+		c.Stderr = stderr
+	}
+	if ctx.Err() != nil {
+		return contextError(ctx, c)
+	}
+	err = currentExecutor().Run(ctx, c)
+	if err != nil && ctx.Err() != nil {
+		return contextError(ctx, c)
+	}
+	var ec exitCoder
+	if errors.As(err, &ec) {
+		log.Printf("执行完成: 返回值(%d)", ec.ExitCode())
 	}
 	return
 }
 
-func ExecuteInDocker(image string, cacheDir string, caches []string, script string) (err error) {
+// contextError 将 ctx 的错误转换为可读的错误，保留原始错误以便使用 errors.Is 判断
+func contextError(ctx context.Context, c Command) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("命令执行超时: %s: %w", c.Name, ctx.Err())
+	}
+	return fmt.Errorf("命令被取消: %s: %w", c.Name, ctx.Err())
+}
+
+func Execute(ctx context.Context, name string, args ...string) (err error) {
+	return ExecuteInDir(ctx, "", name, args...)
+}
+
+// ExecuteInDir 在指定目录下执行命令，dir 为空则使用当前工作目录
+func ExecuteInDir(ctx context.Context, dir string, name string, args ...string) (err error) {
+	return run(ctx, Command{Name: name, Args: args, Dir: dir})
+}
+
+// ExecuteOutput 在指定目录下执行命令，并返回标准输出内容
+func ExecuteOutput(ctx context.Context, dir string, name string, args ...string) (out []byte, err error) {
+	buf := &bytes.Buffer{}
+	err = run(ctx, Command{Name: name, Args: args, Dir: dir, Stdout: buf})
+	out = buf.Bytes()
+	return
+}
+
+// DockerCache 构建缓存
+type DockerCache struct {
+	// Path 容器内路径
+	Path string
+	// Lock 锁模式，可以为 exclusive (默认), shared, none, snapshot
+	Lock string
+	// HostDir 主机目录，为空则使用 CacheDir 下的子目录
+	HostDir string
+}
+
+// DockerRunOptions 在 Docker 容器中执行构建脚本的选项
+type DockerRunOptions struct {
+	// Name 容器名，用于取消时删除容器，为空则自动生成
+	Name      string
+	Image     string
+	CacheDir  string
+	Caches    []DockerCache
+	Workspace string
+	Script    string
+	// LockTimeout 等待缓存锁的超时时间
+	LockTimeout time.Duration
+
+	// Network 容器网络，为空则使用 Docker 默认网络，可以为 host, none 或者网络名
+	Network string
+	// HostPID 使用主机 PID 命名空间
+	HostPID bool
+	// HostIPC 使用主机 IPC 命名空间
+	HostIPC bool
+	// User 容器内执行用户，格式为 "UID:GID"，为空或者为 root 时，在执行后修正工作目录权限
+	User string
+	// ReadOnly 容器根文件系统只读，此时 /tmp 使用 tmpfs
+	ReadOnly bool
+	// CPUs 对应 --cpus
+	CPUs string
+	// Memory 对应 --memory
+	Memory string
+	// PidsLimit 对应 --pids-limit
+	PidsLimit int
+	// Env 附加的环境变量，格式为 "KEY=VALUE"
+	Env []string
+	// Volumes 附加的挂载，格式为 "HOST:CONTAINER[:ro]"
+	Volumes []string
+	// Workdir 容器内执行脚本的目录，相对路径相对于工作目录
+	Workdir string
+	// Shell 执行脚本使用的 Shell，默认为 bash
+	Shell string
+}
+
+// isRootUser 判断 docker run --user 的值是否为 root，空值视为 root
+func isRootUser(user string) bool {
+	switch user {
+	case "", "0", "0:0", "root", "root:root":
+		return true
+	}
+	return false
+}
+
+// CacheHostDir 计算缓存的主机目录
+func (opts DockerRunOptions) CacheHostDir(cache DockerCache) string {
+	if cache.HostDir != "" {
+		return cache.HostDir
+	}
+	return filepath.Join(opts.CacheDir, sanitizePathToPathComponent(cache.Path))
+}
+
+func (opts DockerRunOptions) shell() string {
+	if opts.Shell == "" {
+		return "bash"
+	}
+	return opts.Shell
+}
+
+func (opts DockerRunOptions) workdir() string {
+	if opts.Workdir == "" {
+		return InDockerWorkspace
+	}
+	if path.IsAbs(opts.Workdir) {
+		return opts.Workdir
+	}
+	return path.Join(InDockerWorkspace, opts.Workdir)
+}
+
+// DockerRunMounts 计算所有挂载，格式为 "HOST:CONTAINER[:ro]"
+func DockerRunMounts(opts DockerRunOptions) (mounts []string) {
 	// 将 caches 换算为 mounts
-	var mounts []string
-	for _, cache := range caches {
-		mounts = append(mounts, filepath.Join(cacheDir, sanitizePathToPathComponent(cache))+":"+cache)
+	for _, cache := range opts.Caches {
+		mounts = append(mounts, opts.CacheHostDir(cache)+":"+cache.Path)
 	}
 	// 映射 工作目录
-	var wd string
-	if wd, err = os.Getwd(); err != nil {
-		return
-	}
-	mounts = append(mounts, wd+":"+InDockerWorkspace)
+	mounts = append(mounts, opts.Workspace+":"+InDockerWorkspace)
 	// 映射主脚本
-	mounts = append(mounts, script+":"+InDockerScript)
-	// 准备 Docker 命令
-	name := "docker"
-	args := []string{"run", "-i", "--rm", "--network", "host", "--ipc", "host", "--pid", "host"}
+	mounts = append(mounts, opts.Script+":"+InDockerScript+":ro")
+	// 附加的挂载
+	mounts = append(mounts, opts.Volumes...)
+	return
+}
+
+// DockerRunArgs 生成 docker run 的参数，不包括 docker 本身
+func DockerRunArgs(opts DockerRunOptions) []string {
+	args := []string{"run", "-i", "--rm"}
+	if opts.Name != "" {
+		args = append(args, "--name", opts.Name)
+	}
+	if opts.Network != "" {
+		args = append(args, "--network", opts.Network)
+	}
+	if opts.HostIPC {
+		args = append(args, "--ipc", "host")
+	}
+	if opts.HostPID {
+		args = append(args, "--pid", "host")
+	}
+	if opts.User != "" {
+		args = append(args, "--user", opts.User)
+	}
+	if opts.ReadOnly {
+		args = append(args, "--read-only", "--tmpfs", "/tmp")
+	}
+	if opts.CPUs != "" {
+		args = append(args, "--cpus", opts.CPUs)
+	}
+	if opts.Memory != "" {
+		args = append(args, "--memory", opts.Memory)
+	}
+	if opts.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(opts.PidsLimit))
+	}
+	for _, env := range opts.Env {
+		args = append(args, "-e", env)
+	}
 	// 准备挂载命令
-	for _, mount := range mounts {
+	for _, mount := range DockerRunMounts(opts) {
 		args = append(args, "-v", mount)
 	}
-	// 准备镜像和 bash 命令
-	args = append(args, image, "bash")
+	// 准备镜像和 Shell 命令
+	return append(args, opts.Image, opts.shell())
+}
 
-	// 准备 stdin
+// DockerRunScript 生成通过 stdin 传入容器的引导脚本
+func DockerRunScript(opts DockerRunOptions) []byte {
 	buf := &bytes.Buffer{}
-	_, _ = fmt.Fprintf(buf, "#!/bin/bash\n")
 	_, _ = fmt.Fprintf(buf, "set -eux\n")
-	_, _ = fmt.Fprintf(buf, "cd '%s'\n", InDockerWorkspace)
-	_, _ = fmt.Fprintf(buf, "chmod +x '%s'\n", InDockerScript)
-	_, _ = fmt.Fprintf(buf, "'%s'\n", InDockerScript)
-	_, _ = fmt.Fprintf(buf, "chown -R %d:%d '%s'\n", os.Getuid(), os.Getgid(), InDockerWorkspace)
+	_, _ = fmt.Fprintf(buf, "cd '%s'\n", opts.workdir())
+	_, _ = fmt.Fprintf(buf, "%s '%s'\n", opts.shell(), InDockerScript)
+	if isRootUser(opts.User) {
+		// 以 root 执行时，需要把工作目录的权限改回到宿主机用户
+		_, _ = fmt.Fprintf(buf, "chown -R %d:%d '%s'\n", os.Getuid(), os.Getgid(), InDockerWorkspace)
+	}
+	return buf.Bytes()
+}
+
+// prepareCacheDir 预先创建缓存目录，避免 Docker 以 root 身份创建，并记录缓存的使用，需要在持有缓存锁时调用
+func prepareCacheDir(dir string, path string) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	if err = buildcache.Touch(dir, path); err != nil {
+		log.Printf("无法记录缓存使用: %s", err.Error())
+		err = nil
+	}
+	return
+}
+
+// ExecuteInDocker 在 Docker 容器中执行构建脚本，ctx 取消或者超时后，删除构建容器
+func ExecuteInDocker(ctx context.Context, opts DockerRunOptions) (err error) {
+	// 按照主机目录顺序加锁，避免多个任务互相等待
+	caches := append([]DockerCache{}, opts.Caches...)
+	sort.Slice(caches, func(i, j int) bool {
+		return opts.CacheHostDir(caches[i]) < opts.CacheHostDir(caches[j])
+	})
+	snapshots := map[string]string{}
+	for _, cache := range caches {
+		dir := opts.CacheHostDir(cache)
+		// 锁文件与缓存目录位于同一级，需要预先创建上级目录
+		if err = os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return
+		}
+		switch cache.Lock {
+		case buildcache.LockNone:
+			if err = prepareCacheDir(dir, cache.Path); err != nil {
+				return
+			}
+		case buildcache.LockSnapshot:
+			var unlock func()
+			if unlock, err = buildcache.Lock(ctx, dir, true, opts.LockTimeout); err != nil {
+				return
+			}
+			var snapshot string
+			var cleanup func()
+			if err = prepareCacheDir(dir, cache.Path); err == nil {
+				snapshot, cleanup, err = buildcache.SnapshotLocked(dir)
+			}
+			unlock()
+			if err != nil {
+				return
+			}
+			defer cleanup()
+			snapshots[cache.Path] = snapshot
+			log.Printf("缓存快照: %s -> %s", dir, snapshot)
+		default:
+			var unlock func()
+			if unlock, err = buildcache.Lock(ctx, dir, cache.Lock == buildcache.LockShared, opts.LockTimeout); err != nil {
+				return
+			}
+			defer unlock()
+			if err = prepareCacheDir(dir, cache.Path); err != nil {
+				return
+			}
+		}
+	}
+	// 快照模式的缓存挂载快照目录
+	opts.Caches = append([]DockerCache{}, opts.Caches...)
+	for i, cache := range opts.Caches {
+		if snapshot, ok := snapshots[cache.Path]; ok {
+			opts.Caches[i].HostDir = snapshot
+		}
+	}
 
-	log.Println("使用镜像: ", image)
-	for _, mount := range mounts {
+	log.Println("使用镜像: ", opts.Image)
+	for _, mount := range DockerRunMounts(opts) {
 		log.Println("映射路径: ", mount)
 	}
 
-	log.Printf("执行: %s %s", name, strings.Join(args, " "))
-	cmd := exec.Command(name, args...)
-	cmd.Stdin = buf
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	err = cmd.Run()
-	if ee, ok := err.(*exec.ExitError); ok {
-		log.Printf("执行完成: 返回值(%d)", ee.ExitCode())
+	if opts.Name == "" {
+		opts.Name = fmt.Sprintf("deployer2-builder-%d-%d", os.Getpid(), time.Now().UnixNano())
+	}
+	if err = run(ctx, Command{
+		Name:  "docker",
+		Args:  DockerRunArgs(opts),
+		Stdin: bytes.NewReader(DockerRunScript(opts)),
+	}); err != nil && ctx.Err() != nil {
+		// 终止 docker 客户端不一定会停止容器，需要显式删除
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), CleanupTimeout)
+		defer cancel()
+		_ = Execute(cleanupCtx, "docker", "rm", "-f", opts.Name)
 	}
 	return
 }
 
-func ExecuteWithRetries(retry int, name string, args ...string) (err error) {
-	if retry < 1 {
-		retry = 1
+// DockerNetworkCreateInternal 创建无法访问外部网络的 Docker 网络，并返回网关地址
+func DockerNetworkCreateInternal(ctx context.Context, name string) (gateway string, err error) {
+	if err = Execute(ctx, "docker", "network", "create", "--internal", name); err != nil {
+		return
 	}
-	for {
-		if err = Execute(name, args...); err == nil {
+	var out []byte
+	if out, err = ExecuteOutput(ctx, "", "docker", "network", "inspect", "-f", "{{range .IPAM.Config}}{{.Gateway}}{{end}}", name); err != nil {
+		return
+	}
+	if gateway = strings.TrimSpace(string(out)); gateway == "" {
+		err = fmt.Errorf("无法获取 Docker 网络 %s 的网关地址", name)
+		return
+	}
+	return
+}
+
+func DockerNetworkRemove(ctx context.Context, name string) error {
+	return Execute(ctx, "docker", "network", "rm", name)
+}
+
+// ExecuteWithRetries 按照重试策略执行命令，只重试临时性的失败
+func ExecuteWithRetries(ctx context.Context, policy RetryPolicy, name string, args ...string) (err error) {
+	return ExecuteInputWithRetries(ctx, policy, nil, name, args...)
+}
+
+// ExecuteInputWithRetries 按照重试策略执行命令，每次执行都使用 input 作为标准输入
+func ExecuteInputWithRetries(ctx context.Context, policy RetryPolicy, input []byte, name string, args ...string) (err error) {
+	attempts := policy.attempts()
+	for i := 0; ; i++ {
+		tail := &tailBuffer{}
+		stderr := redact.NewLineWriter(os.Stderr)
+		c := Command{Name: name, Args: args, Stderr: io.MultiWriter(stderr, tail)}
+		if input != nil {
+			c.Stdin = bytes.NewReader(input)
+		}
+		err = run(ctx, c)
+		stderr.Flush()
+		if err == nil {
 			return
 		}
-
-		retry--
-		if retry == 0 {
+		if !IsTransient(err, tail.String()) {
+			log.Printf("不可重试的错误: %s", err.Error())
+			return
+		}
+		if i+1 >= attempts {
 			return
 		}
-		time.Sleep(time.Second * 5)
-		log.Printf("5s 后重试, 剩余 %d", retry)
+		delay := policy.Delay(i)
+		log.Printf("%s 后重试, 剩余 %d", delay.Round(time.Millisecond), attempts-i-1)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
 	}
 }
 
-func DockerVersion() error {
-	return Execute("docker", "--version")
+func DockerVersion(ctx context.Context) error {
+	return Execute(ctx, "docker", "--version")
+}
+
+// DockerBuildOptions docker build 的附加参数
+type DockerBuildOptions struct {
+	// Secrets BuildKit 构建秘密，格式为 "id=ID,src=PATH" 或者 "id=ID,env=NAME"
+	Secrets []string
+	// SSH BuildKit SSH 转发，格式为 "default" 或者 "ID=PATH"
+	SSH []string
+}
+
+func DockerBuild(ctx context.Context, dockerFile, imageName string, contextDir string, opts DockerBuildOptions) error {
+	args := []string{"build", "-t", imageName, "-f", dockerFile}
+	for _, secret := range opts.Secrets {
+		args = append(args, "--secret", secret)
+	}
+	for _, ssh := range opts.SSH {
+		args = append(args, "--ssh", ssh)
+	}
+	args = append(args, contextDir)
+	c := Command{Name: "docker", Args: args}
+	if len(opts.Secrets) > 0 || len(opts.SSH) > 0 {
+		// --secret 和 --ssh 需要启用 BuildKit
+		c.Env = []string{"DOCKER_BUILDKIT=1"}
+	}
+	return run(ctx, c)
 }
 
-func DockerBuild(dockerFile, imageName string) error {
-	return Execute("docker", "build", "-t", imageName, "-f", dockerFile, ".")
+func DockerTag(ctx context.Context, imageName string, imageNameAlt string) error {
+	return Execute(ctx, "docker", "tag", imageName, imageNameAlt)
 }
 
-func DockerTag(imageName string, imageNameAlt string) error {
-	return Execute("docker", "tag", imageName, imageNameAlt)
+func DockerPush(ctx context.Context, policy RetryPolicy, imageName string, configDir string) error {
+	return ExecuteWithRetries(ctx, policy, "docker", "--config", configDir, "push", imageName)
 }
 
-func DockerPush(imageName string, configDir string) error {
-	return Execute("docker", "--config", configDir, "push", imageName)
+// OrasAttach 将目录中的文件作为 OCI 制品附加到镜像上，文件路径相对于 dir
+func OrasAttach(ctx context.Context, imageName string, configDir string, artifactType string, dir string, files []string) error {
+	args := []string{"attach", "--registry-config", filepath.Join(configDir, "config.json"), "--artifact-type", artifactType, imageName}
+	args = append(args, files...)
+	return ExecuteInDir(ctx, dir, "oras", args...)
 }
 
-func DockerRemoveImage(imageName string) error {
-	return Execute("docker", "rmi", imageName)
+func DockerRemoveImage(ctx context.Context, imageName string) error {
+	return Execute(ctx, "docker", "rmi", imageName)
 }
 
-func KubectlVersion(kubeconfig string) error {
-	return ExecuteWithRetries(KubectlPatchRetries, "kubectl", "--kubeconfig", kubeconfig,
+func KubectlVersion(ctx context.Context, policy RetryPolicy, kubeconfig string) error {
+	return ExecuteWithRetries(ctx, policy, "kubectl", "--kubeconfig", kubeconfig,
 		"version")
 }
 
-func KubectlPatch(kubeconfig, namespace, workload, workloadType, patch string) error {
-	return ExecuteWithRetries(KubectlPatchRetries, "kubectl", "--kubeconfig", kubeconfig,
+func KubectlPatch(ctx context.Context, policy RetryPolicy, kubeconfig, namespace, workload, workloadType, patch string) error {
+	return ExecuteWithRetries(ctx, policy, "kubectl", "--kubeconfig", kubeconfig,
 		"--namespace", namespace, "patch", workloadType+"s/"+workload, "-p", patch)
 }
+
+// KubectlAnnotate 设置工作负载的注解，覆盖已有的值
+func KubectlAnnotate(ctx context.Context, policy RetryPolicy, kubeconfig, namespace, workload, workloadType string, annotations ...string) error {
+	args := []string{"--kubeconfig", kubeconfig, "--namespace", namespace, "annotate", "--overwrite", workloadType + "s/" + workload}
+	return ExecuteWithRetries(ctx, policy, "kubectl", append(args, annotations...)...)
+}
+
+func KubectlGet(ctx context.Context, kubeconfig, namespace, workload, workloadType string) ([]byte, error) {
+	return ExecuteOutput(ctx, "", "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "get", workloadType+"s/"+workload, "-o", "json")
+}
+
+// KubectlExists 判断命名空间中的资源是否存在
+func KubectlExists(ctx context.Context, kubeconfig, namespace, workload, workloadType string) (exists bool, err error) {
+	var out []byte
+	if out, err = ExecuteOutput(ctx, "", "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "get", workloadType+"s/"+workload, "--ignore-not-found", "-o", "name"); err != nil {
+		return
+	}
+	exists = len(bytes.TrimSpace(out)) > 0
+	return
+}
+
+// KubectlGetOptional 获取资源，比如 services/hello，资源不存在时返回空内容
+func KubectlGetOptional(ctx context.Context, kubeconfig, namespace, resource string) ([]byte, error) {
+	return ExecuteOutput(ctx, "", "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "get", resource, "--ignore-not-found", "-o", "json")
+}
+
+// KubectlCreate 使用 kubectl create 创建资源，manifest 为 JSON 或者 YAML 格式
+func KubectlCreate(ctx context.Context, policy RetryPolicy, kubeconfig, namespace string, manifest []byte) error {
+	return ExecuteInputWithRetries(ctx, policy, manifest, "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "create", "-f", "-")
+}
+
+// KubectlApply 使用 kubectl apply 创建或者更新资源，manifest 为 JSON 或者 YAML 格式
+func KubectlApply(ctx context.Context, policy RetryPolicy, kubeconfig, namespace string, manifest []byte) error {
+	return ExecuteInputWithRetries(ctx, policy, manifest, "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "apply", "-f", "-")
+}
+
+// KubectlApplyServerSide 使用 server-side apply 创建或者更新资源，字段管理者为 fieldManager
+func KubectlApplyServerSide(ctx context.Context, policy RetryPolicy, kubeconfig, namespace, fieldManager string, manifest []byte) error {
+	return ExecuteInputWithRetries(ctx, policy, manifest, "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "apply", "--server-side", "--field-manager", fieldManager, "-f", "-")
+}
+
+// KubectlList 列出命名空间中指定类型的所有资源
+func KubectlList(ctx context.Context, kubeconfig, namespace, resource string) ([]byte, error) {
+	return ExecuteOutput(ctx, "", "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "get", resource, "-o", "json")
+}
+
+// KubectlListSelector 列出命名空间中指定类型，并且匹配标签选择器的所有资源
+func KubectlListSelector(ctx context.Context, kubeconfig, namespace, resource, selector string) ([]byte, error) {
+	return ExecuteOutput(ctx, "", "kubectl", "--kubeconfig", kubeconfig,
+		"--namespace", namespace, "get", resource, "-l", selector, "-o", "json")
+}
+
+// KubectlDelete 删除命名空间中指定类型的资源，资源不存在时不报错
+func KubectlDelete(ctx context.Context, policy RetryPolicy, kubeconfig, namespace, resource string, names ...string) error {
+	args := []string{"--kubeconfig", kubeconfig, "--namespace", namespace, "delete", resource, "--ignore-not-found"}
+	return ExecuteWithRetries(ctx, policy, "kubectl", append(args, names...)...)
+}
+
+// KubectlAPIVersions 返回集群支持的所有 API 版本
+func KubectlAPIVersions(ctx context.Context, kubeconfig string) (versions []string, err error) {
+	var out []byte
+	if out, err = ExecuteOutput(ctx, "", "kubectl", "--kubeconfig", kubeconfig, "api-versions"); err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			versions = append(versions, line)
+		}
+	}
+	return
+}
+
+func GitRevParse(ctx context.Context, dir string, rev string) (string, error) {
+	out, err := ExecuteOutput(ctx, dir, "git", "rev-parse", rev)
+	return strings.TrimSpace(string(out)), err
+}
+
+// GitDiffNames 返回两个提交之间变化的文件，路径相对于 dir
+func GitDiffNames(ctx context.Context, dir string, from string, to string) (names []string, err error) {
+	var out []byte
+	if out, err = ExecuteOutput(ctx, dir, "git", "diff", "--name-only", "--relative", from, to); err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	return
+}
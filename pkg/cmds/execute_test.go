@@ -0,0 +1,87 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDockerRunArgs(t *testing.T) {
+	opts := DockerRunOptions{
+		Image:     "acicn/jdk-builder:8",
+		CacheDir:  "/home/jenkins/.deployer2-builder-cache/default",
+		Caches:    []DockerCache{{Path: "/root/.m2"}},
+		Workspace: "/data/workspace/hello",
+		Script:    "/tmp/deployer-build.sh",
+		User:      "1000:1000",
+		CPUs:      "2",
+		Memory:    "4g",
+		Env:       []string{"MAVEN_OPTS=-Xmx1g"},
+		Volumes:   []string{"/home/jenkins/.m2/settings.xml:/root/.m2/settings.xml:ro"},
+		Shell:     "sh",
+	}
+	assert.Equal(t, []string{
+		"run", "-i", "--rm",
+		"--user", "1000:1000",
+		"--cpus", "2",
+		"--memory", "4g",
+		"-e", "MAVEN_OPTS=-Xmx1g",
+		"-v", "/home/jenkins/.deployer2-builder-cache/default/root-m2-2214eff0c714668652405dbc6675970d:/root/.m2",
+		"-v", "/data/workspace/hello:/workspace",
+		"-v", "/tmp/deployer-build.sh:/deployer2-in-docker-script.sh:ro",
+		"-v", "/home/jenkins/.m2/settings.xml:/root/.m2/settings.xml:ro",
+		"acicn/jdk-builder:8", "sh",
+	}, DockerRunArgs(opts))
+
+	opts = DockerRunOptions{
+		Image:     "acicn/node-builder:12",
+		Workspace: "/data/workspace/hello",
+		Script:    "/tmp/deployer-build.sh",
+		Network:   "host",
+		HostPID:   true,
+		HostIPC:   true,
+		ReadOnly:  true,
+		PidsLimit: 100,
+	}
+	assert.Equal(t, []string{
+		"run", "-i", "--rm",
+		"--network", "host",
+		"--ipc", "host",
+		"--pid", "host",
+		"--read-only", "--tmpfs", "/tmp",
+		"--pids-limit", "100",
+		"-v", "/data/workspace/hello:/workspace",
+		"-v", "/tmp/deployer-build.sh:/deployer2-in-docker-script.sh:ro",
+		"acicn/node-builder:12", "bash",
+	}, DockerRunArgs(opts))
+}
+
+func TestDockerRunScript(t *testing.T) {
+	script := string(DockerRunScript(DockerRunOptions{Workdir: "frontend", Shell: "sh", User: "1000:1000"}))
+	assert.Equal(t, "set -eux\ncd '/workspace/frontend'\nsh '/deployer2-in-docker-script.sh'\n", script)
+
+	script = string(DockerRunScript(DockerRunOptions{Workdir: "/src"}))
+	assert.Equal(t, fmt.Sprintf("set -eux\ncd '/src'\nbash '/deployer2-in-docker-script.sh'\nchown -R %d:%d '/workspace'\n", os.Getuid(), os.Getgid()), script)
+}
+
+func TestExecute_Timeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	start := time.Now()
+	// 子进程在后台启动孙进程，终止时需要终止整个进程组，否则 Wait 会一直等待输出管道关闭
+	err := Execute(ctx, "sh", "-c", "sleep 30 & wait")
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < KillGracePeriod)
+}
+
+func TestExecute_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := Execute(ctx, "true")
+	assert.True(t, errors.Is(err, context.Canceled))
+}
@@ -0,0 +1,110 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command 要执行的外部命令
+type Command struct {
+	Name string
+	Args []string
+	// Dir 执行目录，为空则使用当前工作目录
+	Dir string
+	// Env 附加的环境变量，格式为 "KEY=VALUE"
+	Env    []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// String 返回命令行，不包括执行目录和环境变量
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Executor 外部命令执行器，pkg/cmds 中的所有函数都通过执行器执行命令，可以替换为测试用的 Recorder 或者远程执行器
+type Executor interface {
+	// Run 执行命令，ctx 取消或者超时后需要终止命令，命令返回非 0 值时，返回的错误需要实现 ExitCode() int
+	Run(ctx context.Context, c Command) error
+}
+
+var (
+	executor   Executor = LocalExecutor{}
+	executorMu sync.RWMutex
+)
+
+// SetExecutor 替换全局执行器，返回之前的执行器
+func SetExecutor(e Executor) (previous Executor) {
+	executorMu.Lock()
+	defer executorMu.Unlock()
+	previous, executor = executor, e
+	return
+}
+
+func currentExecutor() Executor {
+	executorMu.RLock()
+	defer executorMu.RUnlock()
+	return executor
+}
+
+// ExitError 命令返回非 0 值，供非本地执行器使用
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// exitCoder 命令返回非 0 值的错误，*exec.ExitError 和 *ExitError 都实现了该接口
+type exitCoder interface {
+	ExitCode() int
+}
+
+// LocalExecutor 使用 os/exec 在本机执行命令，命令在独立的进程组中执行，ctx 取消或者超时后，终止整个进程组
+type LocalExecutor struct{}
+
+func (LocalExecutor) Run(ctx context.Context, c Command) (err error) {
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	setProcessGroup(cmd)
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		log.Printf("终止命令: %s", c.Name)
+		_ = signalProcessGroup(cmd.Process, false)
+		select {
+		case err = <-done:
+		case <-time.After(KillGracePeriod):
+			log.Printf("强制终止命令: %s", c.Name)
+			_ = signalProcessGroup(cmd.Process, true)
+			err = <-done
+		}
+	}
+	return
+}
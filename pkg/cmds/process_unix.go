@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package cmds
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup 使命令在独立的进程组中执行，以便终止其所有子进程
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup 向进程组发送 SIGTERM，kill 为 true 时发送 SIGKILL
+func signalProcessGroup(p *os.Process, kill bool) error {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	return syscall.Kill(-p.Pid, sig)
+}
@@ -0,0 +1,13 @@
+package cmds
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func signalProcessGroup(p *os.Process, kill bool) error {
+	return p.Kill()
+}
@@ -0,0 +1,77 @@
+package cmds
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// RecordedCommand 记录的命令，Stdin 为命令的标准输入内容
+type RecordedCommand struct {
+	Command
+	Stdin string
+}
+
+// Recorder 记录所有命令而不实际执行的执行器，用于测试
+type Recorder struct {
+	// Handler 可选，模拟命令的执行，返回的内容写入标准输出
+	Handler func(c Command) (stdout string, err error)
+
+	mu       sync.Mutex
+	commands []RecordedCommand
+}
+
+func (r *Recorder) Run(ctx context.Context, c Command) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	rc := RecordedCommand{Command: c}
+	if c.Stdin != nil {
+		var buf []byte
+		if buf, err = ioutil.ReadAll(c.Stdin); err != nil {
+			return
+		}
+		rc.Stdin = string(buf)
+	}
+	r.mu.Lock()
+	r.commands = append(r.commands, rc)
+	r.mu.Unlock()
+	if r.Handler == nil {
+		return
+	}
+	var stdout string
+	stdout, err = r.Handler(c)
+	if stdout != "" && c.Stdout != nil {
+		_, _ = io.WriteString(c.Stdout, stdout)
+	}
+	return
+}
+
+// Commands 返回记录的所有命令
+func (r *Recorder) Commands() []RecordedCommand {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedCommand{}, r.commands...)
+}
+
+// Lines 返回记录的所有命令行，便于断言命令序列
+func (r *Recorder) Lines() []string {
+	var out []string
+	for _, c := range r.Commands() {
+		out = append(out, c.String())
+	}
+	return out
+}
+
+// Match 返回命令行以 prefix 开头的命令
+func (r *Recorder) Match(prefix string) []RecordedCommand {
+	var out []RecordedCommand
+	for _, c := range r.Commands() {
+		if strings.HasPrefix(c.String(), prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"github.com/acicn/deployer2/pkg/buildcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder_DockerBuild(t *testing.T) {
+	r := &Recorder{}
+	defer SetExecutor(SetExecutor(r))
+
+	err := DockerBuild(context.Background(), "/tmp/Dockerfile", "hello:test", "/workspace", DockerBuildOptions{
+		Secrets: []string{"id=npmrc,src=/home/jenkins/.npmrc"},
+	})
+	require.NoError(t, err)
+	err = DockerBuild(context.Background(), "/tmp/Dockerfile", "hello:test", "/workspace", DockerBuildOptions{})
+	require.NoError(t, err)
+
+	commands := r.Commands()
+	require.Len(t, commands, 2)
+	assert.Equal(t, "docker build -t hello:test -f /tmp/Dockerfile --secret id=npmrc,src=/home/jenkins/.npmrc /workspace", commands[0].String())
+	assert.Equal(t, []string{"DOCKER_BUILDKIT=1"}, commands[0].Env)
+	assert.Empty(t, commands[1].Env)
+}
+
+func TestRecorder_DockerPushRetry(t *testing.T) {
+	var count int
+	r := &Recorder{Handler: func(c Command) (string, error) {
+		count++
+		if count < 3 {
+			_, _ = io.WriteString(c.Stderr, "received unexpected HTTP status: 503 Service Unavailable\n")
+			return "", &ExitError{Code: 1}
+		}
+		return "", nil
+	}}
+	defer SetExecutor(SetExecutor(r))
+
+	policy := RetryPolicy{Attempts: 5, InitialDelay: time.Millisecond}
+	require.NoError(t, DockerPush(context.Background(), policy, "registry.example.com/hello:test", "/tmp/dc"))
+	assert.Equal(t, []string{
+		"docker --config /tmp/dc push registry.example.com/hello:test",
+		"docker --config /tmp/dc push registry.example.com/hello:test",
+		"docker --config /tmp/dc push registry.example.com/hello:test",
+	}, r.Lines())
+}
+
+func TestRecorder_KubectlPatchPermanent(t *testing.T) {
+	r := &Recorder{Handler: func(c Command) (string, error) {
+		_, _ = io.WriteString(c.Stderr, `Error from server (Forbidden): deployments.apps "hello" is forbidden`+"\n")
+		return "", &ExitError{Code: 1}
+	}}
+	defer SetExecutor(SetExecutor(r))
+
+	err := KubectlPatch(context.Background(), DefaultRetryPolicy, "/tmp/kc", "default", "hello", "deployment", "{}")
+	require.Error(t, err)
+	assert.Len(t, r.Commands(), 1)
+}
+
+func TestRecorder_ExecuteOutput(t *testing.T) {
+	r := &Recorder{Handler: func(c Command) (string, error) {
+		if c.String() == "git rev-parse HEAD" {
+			return "abcdef\n", nil
+		}
+		return "", fmt.Errorf("unexpected command: %s", c.String())
+	}}
+	defer SetExecutor(SetExecutor(r))
+
+	commit, err := GitRevParse(context.Background(), "/workspace", "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", commit)
+	assert.Equal(t, "/workspace", r.Commands()[0].Dir)
+}
+
+func TestRecorder_ExecuteInDocker(t *testing.T) {
+	r := &Recorder{}
+	defer SetExecutor(SetExecutor(r))
+
+	dir, err := ioutil.TempDir("", "deployer2-cmds-docker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DockerRunOptions{
+		Name:      "deployer2-builder-test",
+		Image:     "acicn/jdk-builder:8",
+		CacheDir:  dir,
+		Caches:    []DockerCache{{Path: "/root/.m2"}},
+		Workspace: "/data/workspace/hello",
+		Script:    "/tmp/deployer-build.sh",
+		User:      "1000:1000",
+	}
+	require.NoError(t, ExecuteInDocker(context.Background(), opts))
+
+	commands := r.Commands()
+	require.Len(t, commands, 1)
+	assert.Equal(t, "docker "+strings.Join(DockerRunArgs(opts), " "), commands[0].String())
+	assert.Equal(t, string(DockerRunScript(opts)), commands[0].Stdin)
+	// 缓存目录已经预先创建
+	_, err = os.Stat(opts.CacheHostDir(opts.Caches[0]))
+	assert.NoError(t, err)
+
+	// 缓存正在被其他任务使用时，等待锁超时之前不会修改缓存目录
+	opts.Caches = []DockerCache{{Path: "/root/.npm"}}
+	opts.LockTimeout = 100 * time.Millisecond
+	cacheDir := opts.CacheHostDir(opts.Caches[0])
+	unlock, err := buildcache.TryLock(cacheDir, false)
+	require.NoError(t, err)
+	defer unlock()
+	assert.Error(t, ExecuteInDocker(context.Background(), opts))
+	_, err = os.Stat(cacheDir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, r.Commands(), 1)
+}
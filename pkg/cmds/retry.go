@@ -0,0 +1,189 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultRetryPolicy 默认重试策略，最多执行 3 次，间隔 2s, 4s，上下浮动 20%
+	DefaultRetryPolicy = RetryPolicy{
+		Attempts:     3,
+		InitialDelay: time.Second * 2,
+		MaxDelay:     time.Second * 30,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+
+	// permanentPatterns 标准错误中出现这些内容时，重试也不会成功，比如权限错误和格式错误，
+	// 只匹配 kubectl 的错误原因 (比如 "Error from server (Forbidden)") 和镜像仓库的错误码 (比如 "denied:")，
+	// 避免误判恰好包含 invalid 等单词的服务端临时故障
+	permanentPatterns = []string{
+		// kubectl 服务端错误原因
+		"(forbidden)",
+		"(unauthorized)",
+		"(invalid)",
+		"(badrequest)",
+		"(notfound)",
+		"(alreadyexists)",
+		"(methodnotallowed)",
+		"(unsupportedmediatype)",
+		"is invalid: ",
+		// kubectl 客户端错误
+		"error: unable to parse",
+		"error converting yaml to json",
+		"error validating",
+		"unknown flag",
+		"unknown command",
+		"the server doesn't have a resource type",
+		// 镜像仓库错误码
+		"denied:",
+		"unauthorized:",
+		"pull access denied",
+		"name unknown",
+		"manifest unknown",
+		"no such image",
+		"invalid reference format",
+		"unprocessable entity",
+	}
+
+	// transientPatterns 标准错误中出现这些内容时，视为网络或者服务端的临时故障
+	transientPatterns = []string{
+		"timeout",
+		"timed out",
+		"connection refused",
+		"connection reset",
+		"broken pipe",
+		"no route to host",
+		"tls handshake",
+		": eof",
+		"unexpected eof",
+		"temporary failure",
+		"too many requests",
+		"toomanyrequests",
+		"service unavailable",
+		"internal error",
+		"bad gateway",
+		"gateway timeout",
+		"(internalerror)",
+		"(serviceunavailable)",
+		"(servertimeout)",
+		"(timeout)",
+		"the object has been modified",
+		"etcdserver",
+		"received unexpected http status: 5",
+	}
+
+	jitterRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterRandMu sync.Mutex
+)
+
+// RetryPolicy 重试策略，重试间隔按照指数增长，并加入随机抖动，避免多个任务同时重试
+type RetryPolicy struct {
+	// Attempts 最多执行的次数，包括第一次
+	Attempts int
+	// InitialDelay 第一次重试前的等待时间
+	InitialDelay time.Duration
+	// MaxDelay 最长等待时间
+	MaxDelay time.Duration
+	// Multiplier 每次重试后等待时间的倍数
+	Multiplier float64
+	// Jitter 等待时间上下浮动的比例，取值 0 到 1
+	Jitter float64
+}
+
+// WithAttempts 返回修改了执行次数的重试策略，attempts 不大于 0 时不修改
+func (p RetryPolicy) WithAttempts(attempts int) RetryPolicy {
+	if attempts > 0 {
+		p.Attempts = attempts
+	}
+	return p
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// Delay 计算第 i 次重试 (从 0 开始) 前的等待时间
+func (p RetryPolicy) Delay(i int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(i))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		jitterRandMu.Lock()
+		r := jitterRand.Float64()
+		jitterRandMu.Unlock()
+		delay = delay * (1 + p.Jitter*(2*r-1))
+	}
+	return time.Duration(delay)
+}
+
+// IsTransient 根据错误，返回值和标准错误判断失败是否为临时性的，临时性的失败可以重试
+func IsTransient(err error, stderr string) bool {
+	if err == nil {
+		return false
+	}
+	// 超时或者取消
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ee exitCoder
+	if !errors.As(err, &ee) {
+		// 命令无法启动，比如命令不存在
+		return false
+	}
+	switch ee.ExitCode() {
+	case 126, 127:
+		// 命令无法执行或者不存在
+		return false
+	case -1:
+		// 被信号终止
+		return true
+	}
+	stderr = strings.ToLower(stderr)
+	for _, pattern := range permanentPatterns {
+		if strings.Contains(stderr, pattern) {
+			return false
+		}
+	}
+	for _, pattern := range transientPatterns {
+		if strings.Contains(stderr, pattern) {
+			return true
+		}
+	}
+	// 无法判断的失败，保持以往的行为，视为可以重试
+	return true
+}
+
+// tailBufferSize 用于判断失败原因的标准错误的最大长度
+const tailBufferSize = 16 * 1024
+
+// tailBuffer 只保留最后写入的一部分内容
+type tailBuffer struct {
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > tailBufferSize {
+		t.buf = t.buf[len(t.buf)-tailBufferSize:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
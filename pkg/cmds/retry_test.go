@@ -0,0 +1,114 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCommand 生成前 n 次执行失败并输出 stderr 的脚本，返回脚本路径和计数文件路径
+func fakeCommand(t *testing.T, n int, stderr string) (script string, counter string) {
+	dir, err := ioutil.TempDir("", "deployer2-cmds-retry")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	counter = filepath.Join(dir, "count")
+	script = filepath.Join(dir, "fake.sh")
+	content := `#!/bin/sh
+c=$(cat '` + counter + `' 2>/dev/null || echo 0)
+c=$((c+1))
+echo $c > '` + counter + `'
+if [ $c -le ` + strconv.Itoa(n) + ` ]; then
+  echo '` + stderr + `' >&2
+  exit 1
+fi
+`
+	require.NoError(t, ioutil.WriteFile(script, []byte(content), 0755))
+	return
+}
+
+func readCount(t *testing.T, counter string) string {
+	buf, err := ioutil.ReadFile(counter)
+	require.NoError(t, err)
+	return strings.TrimSpace(string(buf))
+}
+
+var testRetryPolicy = RetryPolicy{
+	Attempts:     4,
+	InitialDelay: time.Millisecond,
+	MaxDelay:     time.Millisecond * 10,
+	Multiplier:   2,
+	Jitter:       0.5,
+}
+
+func TestExecuteWithRetries_Transient(t *testing.T) {
+	script, counter := fakeCommand(t, 2, "dial tcp 10.0.0.1:443: connect: connection refused")
+	err := ExecuteWithRetries(context.Background(), testRetryPolicy, script)
+	require.NoError(t, err)
+	assert.Equal(t, "3", readCount(t, counter))
+}
+
+func TestExecuteWithRetries_Exhausted(t *testing.T) {
+	script, counter := fakeCommand(t, 9, "net/http: TLS handshake timeout")
+	err := ExecuteWithRetries(context.Background(), testRetryPolicy, script)
+	require.Error(t, err)
+	assert.Equal(t, "4", readCount(t, counter))
+}
+
+func TestExecuteWithRetries_Permanent(t *testing.T) {
+	script, counter := fakeCommand(t, 2, `Error from server (Forbidden): deployments.apps "hello" is forbidden`)
+	err := ExecuteWithRetries(context.Background(), testRetryPolicy, script)
+	require.Error(t, err)
+	assert.Equal(t, "1", readCount(t, counter))
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: time.Second, MaxDelay: time.Second * 5, Multiplier: 2}
+	assert.Equal(t, time.Second, p.Delay(0))
+	assert.Equal(t, time.Second*2, p.Delay(1))
+	assert.Equal(t, time.Second*4, p.Delay(2))
+	assert.Equal(t, time.Second*5, p.Delay(3))
+
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		d := p.Delay(1)
+		assert.True(t, d >= time.Millisecond*1600 && d <= time.Millisecond*2400, d.String())
+	}
+
+	assert.Equal(t, 5, p.WithAttempts(5).Attempts)
+	assert.Equal(t, 3, DefaultRetryPolicy.WithAttempts(0).Attempts)
+}
+
+func TestIsTransient(t *testing.T) {
+	exitErr := func(code string) error {
+		return exec.Command("sh", "-c", "exit "+code).Run()
+	}
+	assert.False(t, IsTransient(nil, ""))
+	assert.False(t, IsTransient(context.Canceled, ""))
+	assert.False(t, IsTransient(errors.New("exec: not found"), ""))
+	assert.False(t, IsTransient(exitErr("127"), ""))
+	assert.True(t, IsTransient(exitErr("1"), "unknown failure"))
+	assert.True(t, IsTransient(exitErr("1"), "Error from server (ServiceUnavailable): the server is currently unable to handle the request"))
+	assert.True(t, IsTransient(exitErr("1"), "toomanyrequests: Rate exceeded"))
+	assert.False(t, IsTransient(exitErr("1"), `error: unable to parse "{": yaml: line 1: did not find expected node content`))
+	assert.False(t, IsTransient(exitErr("1"), "denied: requested access to the resource is denied"))
+	assert.False(t, IsTransient(exitErr("1"), `Error from server (NotFound): deployments.apps "hello" not found`))
+	assert.False(t, IsTransient(exitErr("1"), `Error from server (AlreadyExists): deployments.apps "hello" already exists`))
+	assert.False(t, IsTransient(exitErr("1"), `The Deployment "hello" is invalid: spec.replicas: Invalid value: -1`))
+	assert.False(t, IsTransient(exitErr("1"), `Error from server (Invalid): error when applying patch`))
+	assert.False(t, IsTransient(exitErr("1"), "unauthorized: authentication required"))
+	assert.False(t, IsTransient(exitErr("1"), "Error response from daemon: pull access denied for hello, repository does not exist or may require 'docker login'"))
+	// 服务端临时故障返回的 HTML 页面被当作 JSON 解析，包含 invalid 但是可以重试
+	assert.True(t, IsTransient(exitErr("1"), `Error from server (InternalError): an error on the server ("invalid character '<' looking for beginning of value") has prevented the request from succeeding`))
+	assert.True(t, IsTransient(exitErr("1"), `error parsing HTTP 502 response body: invalid character '<' looking for beginning of value: "<html>Bad Gateway</html>"`))
+	assert.True(t, IsTransient(exitErr("1"), `Get "https://registry.example.com/v2/": EOF`))
+	assert.True(t, IsTransient(exitErr("1"), "unexpected EOF"))
+}
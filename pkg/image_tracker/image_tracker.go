@@ -1,6 +1,7 @@
 package image_tracker
 
 import (
+	"context"
 	"github.com/acicn/deployer2/pkg/cmds"
 	"log"
 	"sync"
@@ -8,7 +9,7 @@ import (
 
 type ImageTracker interface {
 	Add(name string)
-	DeleteAll()
+	DeleteAll(ctx context.Context)
 }
 
 type imageTracker struct {
@@ -22,10 +23,10 @@ func (i *imageTracker) Add(name string) {
 	i.images[name] = struct{}{}
 }
 
-func (i *imageTracker) DeleteAll() {
+func (i *imageTracker) DeleteAll(ctx context.Context) {
 	log.Println("清理镜像")
 	for name := range i.images {
-		_ = cmds.DockerRemoveImage(name)
+		_ = cmds.DockerRemoveImage(ctx, name)
 	}
 }
 
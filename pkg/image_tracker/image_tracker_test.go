@@ -0,0 +1,24 @@
+package image_tracker
+
+import (
+	"context"
+	"github.com/acicn/deployer2/pkg/cmds"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestImageTracker_DeleteAll(t *testing.T) {
+	r := &cmds.Recorder{}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	it := New()
+	it.Add("hello:test")
+	it.Add("registry.example.com/hello:test")
+	it.Add("hello:test")
+	it.DeleteAll(context.Background())
+
+	assert.ElementsMatch(t, []string{
+		"docker rmi hello:test",
+		"docker rmi registry.example.com/hello:test",
+	}, r.Lines())
+}
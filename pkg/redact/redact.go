@@ -0,0 +1,132 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Mask 敏感值的替代文本
+	Mask = "******"
+
+	// minLength 过短的值替换后反而会误伤正常日志，不予处理
+	minLength = 4
+
+	// maxLineLength 单行超过该长度时直接输出，避免进度条等不换行的输出被无限缓冲
+	maxLineLength = 64 * 1024
+)
+
+var (
+	l      sync.RWMutex
+	values []string
+)
+
+// Add 登记需要在日志中隐藏的敏感值
+func Add(vs ...string) {
+	l.Lock()
+	defer l.Unlock()
+	for _, v := range vs {
+		v = strings.TrimSpace(v)
+		if len(v) < minLength {
+			continue
+		}
+		found := false
+		for _, e := range values {
+			if e == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, v)
+		}
+	}
+	// 优先替换较长的值，避免较短的值破坏较长的值
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+}
+
+// Reset 清空所有登记的敏感值
+func Reset() {
+	l.Lock()
+	defer l.Unlock()
+	values = nil
+}
+
+// String 隐藏字符串中的所有敏感值
+func String(s string) string {
+	l.RLock()
+	defer l.RUnlock()
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v, Mask)
+	}
+	return s
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	if _, err = io.WriteString(w.w, String(string(p))); err != nil {
+		return
+	}
+	n = len(p)
+	return
+}
+
+// NewWriter 创建一个隐藏敏感值的 io.Writer，适用于 log.SetOutput 这种每次写入完整行的场景
+func NewWriter(w io.Writer) io.Writer {
+	return &writer{w: w}
+}
+
+// LineWriter 按行缓冲并隐藏敏感值的 io.Writer，适用于子进程输出这种任意切分的场景，使用完毕后需要调用 Flush
+type LineWriter struct {
+	l   sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+// NewLineWriter 创建一个 LineWriter
+func NewLineWriter(w io.Writer) *LineWriter {
+	return &LineWriter{w: w}
+}
+
+func (w *LineWriter) Write(p []byte) (n int, err error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.buf = append(w.buf, p...)
+	if i := bytes.LastIndexByte(w.buf, '\n'); i >= 0 {
+		if _, err = io.WriteString(w.w, String(string(w.buf[:i+1]))); err != nil {
+			return
+		}
+		w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	}
+	if len(w.buf) > maxLineLength {
+		if err = w.flush(); err != nil {
+			return
+		}
+	}
+	n = len(p)
+	return
+}
+
+func (w *LineWriter) flush() (err error) {
+	if len(w.buf) == 0 {
+		return
+	}
+	_, err = io.WriteString(w.w, String(string(w.buf)))
+	w.buf = w.buf[:0]
+	return
+}
+
+// Flush 输出缓冲区中剩余的内容
+func (w *LineWriter) Flush() error {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.flush()
+}
@@ -0,0 +1,39 @@
+package redact
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	defer Reset()
+	Add("s3cr3t-token", "abc", "s3cr3t")
+	assert.Equal(t, "token=******, short=abc", String("token=s3cr3t-token, short=abc"))
+	assert.Equal(t, "****** ******", String("s3cr3t s3cr3t"))
+}
+
+func TestNewWriter(t *testing.T) {
+	defer Reset()
+	Add("p@ssw0rd")
+	buf := &bytes.Buffer{}
+	logger := log.New(NewWriter(buf), "", 0)
+	logger.Println("password is p@ssw0rd")
+	assert.Equal(t, "password is ******\n", buf.String())
+}
+
+func TestLineWriter(t *testing.T) {
+	defer Reset()
+	Add("p@ssw0rd")
+	buf := &bytes.Buffer{}
+	w := NewLineWriter(buf)
+	_, _ = w.Write([]byte("login p@ss"))
+	assert.Equal(t, "", buf.String())
+	_, _ = w.Write([]byte("w0rd\nnext p@ssw"))
+	assert.Equal(t, "login ******\n", buf.String())
+	_, _ = w.Write([]byte("0rd"))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "login ******\nnext ******", buf.String())
+}
@@ -0,0 +1,305 @@
+package remotecache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Backend 远程缓存存储
+type Backend interface {
+	// Exists 判断缓存是否存在
+	Exists(ctx context.Context, key string) (bool, error)
+	// Get 下载缓存
+	Get(ctx context.Context, key string, w io.Writer) error
+	// Put 上传缓存
+	Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error
+}
+
+var (
+	regexpNonKeyChars = regexp.MustCompile(`[^0-9a-zA-Z._-]+`)
+)
+
+// Key 计算远程缓存的键，由缓存组，容器内路径和文件 (比如 package-lock.json) 的内容哈希组成，patterns 为相对于 dir 的 glob 模式
+func Key(group string, path string, dir string, patterns []string) (key string, err error) {
+	var files []string
+	for _, pattern := range patterns {
+		var matches []string
+		if matches, err = filepath.Glob(filepath.Join(dir, pattern)); err != nil {
+			return
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		err = fmt.Errorf("找不到用于计算缓存键的文件: %s", strings.Join(patterns, ", "))
+		return
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, file := range files {
+		var rel string
+		if rel, err = filepath.Rel(dir, file); err != nil {
+			return
+		}
+		_, _ = io.WriteString(h, filepath.ToSlash(rel)+"\n")
+		var f *os.File
+		if f, err = os.Open(file); err != nil {
+			return
+		}
+		_, err = io.Copy(h, f)
+		_ = f.Close()
+		if err != nil {
+			return
+		}
+	}
+	name := strings.Trim(regexpNonKeyChars.ReplaceAllString(path, "-"), "-")
+	key = regexpNonKeyChars.ReplaceAllString(group, "-") + "/" + name + "-" + hex.EncodeToString(h.Sum(nil))[:16] + ".tar.gz"
+	return
+}
+
+// Archive 将目录打包为 tar.gz 格式
+func Archive(dir string, w io.Writer) (err error) {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	if err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var rel string
+		if rel, err = filepath.Rel(dir, path); err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			// 忽略 socket, 管道等特殊文件
+			return nil
+		}
+		var hdr *tar.Header
+		if hdr, err = tar.FileInfoHeader(info, link); err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			var f *os.File
+			if f, err = os.Open(path); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			_ = f.Close()
+			return err
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	err = zw.Close()
+	return
+}
+
+// Extract 将 tar.gz 解压到目录，拒绝指向目录之外的路径
+func Extract(r io.Reader, dir string) (err error) {
+	var zr *gzip.Reader
+	if zr, err = gzip.NewReader(r); err != nil {
+		return
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			err = fmt.Errorf("缓存归档中包含非法路径: %s", hdr.Name)
+			return
+		}
+		target := filepath.Join(dir, name)
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, mode|0700); err != nil {
+				return
+			}
+		case tar.TypeSymlink:
+			// 拒绝指向目录之外的符号链接，避免后续文件通过符号链接写入目录之外
+			link := filepath.Clean(filepath.Join(filepath.Dir(name), filepath.FromSlash(hdr.Linkname)))
+			if filepath.IsAbs(hdr.Linkname) || link == ".." || strings.HasPrefix(link, ".."+string(filepath.Separator)) {
+				err = fmt.Errorf("缓存归档中包含非法符号链接: %s -> %s", hdr.Name, hdr.Linkname)
+				return
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return
+			}
+			_ = os.Remove(target)
+			if err = os.Symlink(hdr.Linkname, target); err != nil {
+				return
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return
+			}
+			var f *os.File
+			if f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode); err != nil {
+				return
+			}
+			_, err = io.Copy(f, tr)
+			_ = f.Close()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Restore 从远程缓存下载并解压到目录，返回缓存是否存在
+func Restore(ctx context.Context, b Backend, key string, dir string) (ok bool, err error) {
+	if ok, err = b.Exists(ctx, key); err != nil || !ok {
+		return
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile("", "deployer2-remote-cache"); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = b.Get(ctx, key, f); err != nil {
+		return
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	err = Extract(f, dir)
+	return
+}
+
+// Pack 打包目录到临时文件，返回的文件已经定位到开头，调用方负责关闭并删除
+func Pack(dir string) (f *os.File, size int64, err error) {
+	if f, err = ioutil.TempFile("", "deployer2-remote-cache"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			f = nil
+		}
+	}()
+	if err = Archive(dir, f); err != nil {
+		return
+	}
+	if size, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return
+}
+
+// Save 打包目录并上传到远程缓存
+func Save(ctx context.Context, b Backend, key string, dir string) (err error) {
+	var f *os.File
+	var size int64
+	if f, size, err = Pack(dir); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	err = b.Put(ctx, key, f, size)
+	return
+}
+
+// LocalBackend 使用本地目录 (比如 NFS 挂载的共享目录) 作为远程缓存存储
+type LocalBackend struct {
+	Dir string
+}
+
+func (b *LocalBackend) file(key string) string {
+	return filepath.Join(b.Dir, filepath.FromSlash(key))
+}
+
+func (b *LocalBackend) Exists(ctx context.Context, key string) (ok bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if _, err = os.Stat(b.file(key)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	ok = true
+	return
+}
+
+func (b *LocalBackend) Get(ctx context.Context, key string, w io.Writer) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = os.Open(b.file(key)); err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return
+}
+
+func (b *LocalBackend) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	file := b.file(key)
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return
+	}
+	// 先写入临时文件再重命名，避免其他任务读取到不完整的内容
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(file), ".uploading-"); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	var n int64
+	if n, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if n != size {
+		err = errors.New("写入的缓存大小不一致")
+		return
+	}
+	err = os.Rename(f.Name(), file)
+	return
+}
@@ -0,0 +1,189 @@
+package remotecache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func createTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "deployer2-remotecache")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "data"), []byte("hello"), 0644))
+	require.NoError(t, os.Symlink("sub/data", filepath.Join(dir, "link")))
+	return dir
+}
+
+func assertTestDir(t *testing.T, dir string) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "sub", "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	link, err := os.Readlink(filepath.Join(dir, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "sub/data", link)
+}
+
+func TestKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer2-remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "package-lock.json"), []byte("v1"), 0644))
+
+	key1, err := Key("biz", "/root/.npm", dir, []string{"package-lock.json"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key1, "biz/root-.npm-"))
+	assert.True(t, strings.HasSuffix(key1, ".tar.gz"))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "package-lock.json"), []byte("v2"), 0644))
+	key2, err := Key("biz", "/root/.npm", dir, []string{"package-lock.json"})
+	require.NoError(t, err)
+	assert.NotEqual(t, key1, key2)
+
+	_, err = Key("biz", "/root/.npm", dir, []string{"pom.xml"})
+	assert.Error(t, err)
+}
+
+func TestArchiveExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer2-remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src := createTestDir(t)
+	defer os.RemoveAll(src)
+	buf := &bytes.Buffer{}
+	require.NoError(t, Archive(src, buf))
+	require.NoError(t, Extract(buf, filepath.Join(dir, "ok")))
+	assertTestDir(t, filepath.Join(dir, "ok"))
+
+	// 拒绝指向目录之外的路径
+	buf.Reset()
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	_, err = tw.Write([]byte("evil"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	assert.Error(t, Extract(buf, filepath.Join(dir, "evil")))
+	_, err = os.Stat(filepath.Join(dir, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLocalBackend(t *testing.T) {
+	src := createTestDir(t)
+	defer os.RemoveAll(src)
+	store, err := ioutil.TempDir("", "deployer2-remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(store)
+
+	b := &LocalBackend{Dir: store}
+	ok, err := Restore(context.Background(), b, "biz/npm.tar.gz", filepath.Join(store, "restored"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, Save(context.Background(), b, "biz/npm.tar.gz", src))
+	ok, err = Restore(context.Background(), b, "biz/npm.tar.gz", filepath.Join(store, "restored"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assertTestDir(t, filepath.Join(store, "restored"))
+}
+
+func TestS3Backend(t *testing.T) {
+	var l sync.Mutex
+	objects := map[string][]byte{}
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=test-access/") ||
+			!strings.Contains(auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") ||
+			req.Header.Get("X-Amz-Date") == "" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		l.Lock()
+		defer l.Unlock()
+		switch req.Method {
+		case http.MethodHead, http.MethodGet:
+			buf, ok := objects[req.URL.Path]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if req.Method == http.MethodGet {
+				_, _ = rw.Write(buf)
+			}
+		case http.MethodPut:
+			buf, _ := ioutil.ReadAll(req.Body)
+			if int64(len(buf)) != req.ContentLength {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[req.URL.Path] = buf
+		}
+	}))
+	defer s.Close()
+
+	src := createTestDir(t)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "deployer2-remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	b := &S3Backend{
+		Endpoint:  s.URL,
+		Bucket:    "caches",
+		Prefix:    "deployer2/",
+		AccessKey: "test-access",
+		SecretKey: "test-secret",
+	}
+	ok, err := Restore(context.Background(), b, "biz/npm.tar.gz", dst)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, Save(context.Background(), b, "biz/npm.tar.gz", src))
+	assert.Contains(t, objects, "/caches/deployer2/biz/npm.tar.gz")
+
+	ok, err = Restore(context.Background(), b, "biz/npm.tar.gz", dst)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assertTestDir(t, dst)
+
+	b.AccessKey = "wrong"
+	_, err = b.Exists(context.Background(), "biz/npm.tar.gz")
+	assert.Error(t, err)
+}
+
+func TestS3EscapePath(t *testing.T) {
+	assert.Equal(t, "/caches/a%20b/c~d.tar.gz", s3EscapePath("/caches/a b/c~d.tar.gz"))
+}
+
+func TestBackend_Canceled(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+	store, err := ioutil.TempDir("", "deployer2-remotecache")
+	require.NoError(t, err)
+	defer os.RemoveAll(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, b := range []Backend{
+		&LocalBackend{Dir: store},
+		&S3Backend{Endpoint: s.URL, Bucket: "caches"},
+	} {
+		_, err = b.Exists(ctx, "biz/npm.tar.gz")
+		assert.Error(t, err)
+		assert.Error(t, b.Put(ctx, "biz/npm.tar.gz", bytes.NewReader([]byte("x")), 1))
+	}
+}
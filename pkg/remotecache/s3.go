@@ -0,0 +1,179 @@
+package remotecache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Backend 使用 S3 兼容的对象存储 (比如 MinIO, COS, OSS) 作为远程缓存存储，使用路径风格 (Path Style) 的地址和 AWS 签名 V4
+type S3Backend struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (b *S3Backend) client() *http.Client {
+	if b.Client != nil {
+		return b.Client
+	}
+	return http.DefaultClient
+}
+
+func (b *S3Backend) region() string {
+	if b.Region == "" {
+		return "us-east-1"
+	}
+	return b.Region
+}
+
+// s3EscapePath 按照 AWS 签名 V4 的要求编码路径，除 "/" 外只保留非保留字符
+func s3EscapePath(p string) string {
+	sb := &strings.Builder{}
+	for _, c := range []byte(p) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			sb.WriteByte(c)
+		} else {
+			_, _ = fmt.Fprintf(sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// sign 使用 AWS 签名 V4 为请求签名
+func (b *S3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+	scope := date + "/" + b.region() + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+b.SecretKey), date)
+	key = hmacSHA256(key, b.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func (b *S3Backend) request(ctx context.Context, method string, key string, body io.Reader, size int64) (res *http.Response, err error) {
+	var u *url.URL
+	if u, err = url.Parse(strings.TrimSuffix(b.Endpoint, "/")); err != nil {
+		return
+	}
+	u.Path = u.Path + "/" + b.Bucket + "/" + strings.TrimPrefix(b.Prefix+key, "/")
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, u.String(), body); err != nil {
+		return
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	b.sign(req, time.Now())
+	res, err = b.client().Do(req)
+	return
+}
+
+func (b *S3Backend) Exists(ctx context.Context, key string) (ok bool, err error) {
+	var res *http.Response
+	if res, err = b.request(ctx, http.MethodHead, key, nil, 0); err != nil {
+		return
+	}
+	_ = res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		ok = true
+	case http.StatusNotFound:
+	default:
+		err = fmt.Errorf("查询远程缓存 %s 失败: %s", key, res.Status)
+	}
+	return
+}
+
+func (b *S3Backend) Get(ctx context.Context, key string, w io.Writer) (err error) {
+	var res *http.Response
+	if res, err = b.request(ctx, http.MethodGet, key, nil, 0); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("下载远程缓存 %s 失败: %s", key, res.Status)
+		return
+	}
+	_, err = io.Copy(w, res.Body)
+	return
+}
+
+func (b *S3Backend) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) (err error) {
+	var res *http.Response
+	if res, err = b.request(ctx, http.MethodPut, key, r, size); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("上传远程缓存 %s 失败: %s", key, res.Status)
+		return
+	}
+	return
+}
@@ -0,0 +1,169 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/acicn/deployer2/pkg/cmds"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Provider 从外部存储读取秘密值
+type Provider interface {
+	Get(ctx context.Context, ref string) (string, error)
+}
+
+// splitRef 将 "PATH#KEY" 格式的引用拆分为 PATH 和 KEY
+func splitRef(ref string) (p string, key string, err error) {
+	splits := strings.SplitN(ref, "#", 2)
+	if len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+		err = fmt.Errorf("秘密引用格式不正确，应为 \"PATH#KEY\": %s", ref)
+		return
+	}
+	p, key = splits[0], splits[1]
+	return
+}
+
+// FileProvider 从本地文件读取秘密值，引用为文件路径，支持 ~ 代表用户主目录
+type FileProvider struct{}
+
+func (FileProvider) Get(ctx context.Context, ref string) (v string, err error) {
+	if strings.HasPrefix(ref, "~/") {
+		var home string
+		if home, err = os.UserHomeDir(); err != nil {
+			return
+		}
+		ref = filepath.Join(home, strings.TrimPrefix(ref, "~/"))
+	}
+	var buf []byte
+	if buf, err = ioutil.ReadFile(ref); err != nil {
+		return
+	}
+	v = strings.TrimRight(string(buf), "\r\n")
+	return
+}
+
+// VaultProvider 从 Vault 兼容的 HTTP KV 接口读取秘密值，引用格式为 "PATH#KEY"，同时支持 KV v1 和 KV v2
+type VaultProvider struct {
+	Addr   string
+	Token  string
+	Client *http.Client
+}
+
+// NewVaultProviderFromEnv 使用环境变量 $VAULT_ADDR 和 $VAULT_TOKEN 创建 VaultProvider
+func NewVaultProviderFromEnv() *VaultProvider {
+	return &VaultProvider{
+		Addr:   os.Getenv("VAULT_ADDR"),
+		Token:  os.Getenv("VAULT_TOKEN"),
+		Client: &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+func (p *VaultProvider) Get(ctx context.Context, ref string) (v string, err error) {
+	if p.Addr == "" {
+		err = errors.New("缺少 Vault 地址，请设置环境变量 $VAULT_ADDR")
+		return
+	}
+	var path, key string
+	if path, key, err = splitRef(ref); err != nil {
+		return
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.Addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil); err != nil {
+		return
+	}
+	if p.Token != "" {
+		req.Header.Set("X-Vault-Token", p.Token)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var res *http.Response
+	if res, err = client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("读取 Vault 秘密 %s 失败: %s", path, res.Status)
+		return
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return
+	}
+	data := body.Data
+	// KV v2 的值位于 data.data 中
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = inner
+		}
+	}
+	raw, ok := data[key]
+	if !ok {
+		err = fmt.Errorf("Vault 秘密 %s 中找不到键 %s", path, key)
+		return
+	}
+	if s, ok := raw.(string); ok {
+		v = s
+	} else {
+		v = fmt.Sprint(raw)
+	}
+	return
+}
+
+// KubernetesProvider 从 Kubernetes 集群的 Secret 读取秘密值，引用格式为 "[CLUSTER/]NAMESPACE/NAME#KEY"
+type KubernetesProvider struct {
+	// DefaultCluster 引用中未指定集群时使用的集群
+	DefaultCluster string
+	// Kubeconfig 获取集群对应的 kubeconfig 文件
+	Kubeconfig func(cluster string) (string, error)
+}
+
+func (p *KubernetesProvider) Get(ctx context.Context, ref string) (v string, err error) {
+	var path, key string
+	if path, key, err = splitRef(ref); err != nil {
+		return
+	}
+	splits := strings.Split(path, "/")
+	if len(splits) == 2 {
+		splits = append([]string{p.DefaultCluster}, splits...)
+	}
+	if len(splits) != 3 || splits[0] == "" {
+		err = fmt.Errorf("Kubernetes 秘密引用格式不正确，应为 \"[CLUSTER/]NAMESPACE/NAME#KEY\": %s", ref)
+		return
+	}
+	var kcFile string
+	if kcFile, err = p.Kubeconfig(splits[0]); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = cmds.KubectlGet(ctx, kcFile, splits[1], splits[2], "secret"); err != nil {
+		return
+	}
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	if err = json.Unmarshal(buf, &secret); err != nil {
+		return
+	}
+	raw, ok := secret.Data[key]
+	if !ok {
+		err = fmt.Errorf("Kubernetes 秘密 %s 中找不到键 %s", path, key)
+		return
+	}
+	if buf, err = base64.StdEncoding.DecodeString(raw); err != nil {
+		return
+	}
+	v = string(buf)
+	return
+}
@@ -0,0 +1,116 @@
+package secrets
+
+import (
+	"context"
+	"github.com/acicn/deployer2/pkg/cmds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileProvider_Get(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer2-secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(file, []byte("hello-token\n"), 0600))
+
+	v, err := FileProvider{}.Get(context.Background(), file)
+	require.NoError(t, err)
+	assert.Equal(t, "hello-token", v)
+
+	_, err = FileProvider{}.Get(context.Background(), filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestVaultProvider_Get(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "test-token" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/hello":
+			_, _ = rw.Write([]byte(`{"data":{"data":{"password":"v2-pass"},"metadata":{"version":1}}}`))
+		case "/v1/kv/hello":
+			_, _ = rw.Write([]byte(`{"data":{"password":"v1-pass"}}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	p := &VaultProvider{Addr: s.URL, Token: "test-token"}
+	v, err := p.Get(context.Background(), "secret/data/hello#password")
+	require.NoError(t, err)
+	assert.Equal(t, "v2-pass", v)
+
+	v, err = p.Get(context.Background(), "kv/hello#password")
+	require.NoError(t, err)
+	assert.Equal(t, "v1-pass", v)
+
+	_, err = p.Get(context.Background(), "kv/hello#username")
+	assert.Error(t, err)
+	_, err = p.Get(context.Background(), "kv/missing#password")
+	assert.Error(t, err)
+	_, err = p.Get(context.Background(), "kv/hello")
+	assert.Error(t, err)
+
+	p.Token = "bad-token"
+	_, err = p.Get(context.Background(), "kv/hello#password")
+	assert.Error(t, err)
+}
+
+func TestKubernetesProvider_Get(t *testing.T) {
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		if strings.HasSuffix(c.String(), " get secrets/db -o json") {
+			// "aGVsbG8tcGFzcw==" 为 "hello-pass" 的 base64 编码
+			return `{"data":{"password":"aGVsbG8tcGFzcw==","broken":"!!!"}}`, nil
+		}
+		return "", &cmds.ExitError{Code: 1}
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	p := &KubernetesProvider{
+		DefaultCluster: "test",
+		Kubeconfig: func(cluster string) (string, error) {
+			return "/kubeconfig-" + cluster, nil
+		},
+	}
+
+	// 未指定集群时使用默认集群
+	v, err := p.Get(context.Background(), "prod/db#password")
+	require.NoError(t, err)
+	assert.Equal(t, "hello-pass", v)
+	assert.Equal(t, []string{
+		"kubectl --kubeconfig /kubeconfig-test --namespace prod get secrets/db -o json",
+	}, r.Lines())
+
+	// 指定集群
+	v, err = p.Get(context.Background(), "staging/prod/db#password")
+	require.NoError(t, err)
+	assert.Equal(t, "hello-pass", v)
+	assert.Equal(t, "kubectl --kubeconfig /kubeconfig-staging --namespace prod get secrets/db -o json", r.Lines()[1])
+
+	// 键不存在或者不是合法的 base64
+	_, err = p.Get(context.Background(), "prod/db#missing")
+	assert.Error(t, err)
+	_, err = p.Get(context.Background(), "prod/db#broken")
+	assert.Error(t, err)
+
+	// 格式不正确的引用不执行命令
+	start := len(r.Commands())
+	for _, ref := range []string{"db#password", "a/b/c/d#password", "prod/db"} {
+		_, err = p.Get(context.Background(), ref)
+		assert.Error(t, err, ref)
+	}
+	_, err = (&KubernetesProvider{Kubeconfig: p.Kubeconfig}).Get(context.Background(), "prod/db#password")
+	assert.Error(t, err)
+	assert.Len(t, r.Commands(), start)
+}
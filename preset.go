@@ -1,13 +1,16 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"github.com/acicn/deployer2/pkg/redact"
 	"github.com/guoyk93/tempfile"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type Preset struct {
@@ -21,6 +24,20 @@ type Preset struct {
 			Auth string `json:"auth"`
 		} `json:"auths"`
 	} `yaml:"dockerconfig"`
+	// Timeouts 集群级别的超时时间，只有 push 和 deploy 生效，优先级低于环境配置
+	Timeouts Timeouts `yaml:"timeouts"`
+	// Retries 临时性失败的最多执行次数
+	Retries PresetRetries `yaml:"retries"`
+	// Scheduling 集群默认的 Pod 调度配置，环境配置中的 scheduling 优先
+	Scheduling UniversalScheduling `yaml:"scheduling"`
+}
+
+// PresetRetries 各阶段命令的最多执行次数，包括第一次，不设置则使用默认值 3
+type PresetRetries struct {
+	// Push 推送镜像
+	Push int `yaml:"push"`
+	// Deploy 执行 kubectl 命令
+	Deploy int `yaml:"deploy"`
 }
 
 func LoadPresetFromHome(cluster string, p *Preset) (err error) {
@@ -47,8 +64,77 @@ func LoadPresetFile(filename string, p *Preset) (err error) {
 	return
 }
 
-func LoadPreset(buf []byte, p *Preset) error {
-	return yaml.Unmarshal(buf, p)
+func LoadPreset(buf []byte, p *Preset) (err error) {
+	if err = yaml.Unmarshal(buf, p); err != nil {
+		return
+	}
+	p.RegisterSensitive()
+	return
+}
+
+var (
+	sensitiveKubeconfigKeys = map[string]bool{
+		"token":                   true,
+		"password":                true,
+		"client-key-data":         true,
+		"client-certificate-data": true,
+		"id-token":                true,
+		"refresh-token":           true,
+		"access-token":            true,
+		"client-secret":           true,
+	}
+)
+
+func collectSensitiveKubeconfig(v interface{}, out *[]string) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			if ks, ok := k.(string); ok && sensitiveKubeconfigKeys[ks] {
+				if s, ok := item.(string); ok {
+					*out = append(*out, s)
+					continue
+				}
+			}
+			collectSensitiveKubeconfig(item, out)
+		}
+	case map[string]interface{}:
+		for k, item := range v {
+			if sensitiveKubeconfigKeys[k] {
+				if s, ok := item.(string); ok {
+					*out = append(*out, s)
+					continue
+				}
+			}
+			collectSensitiveKubeconfig(item, out)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectSensitiveKubeconfig(item, out)
+		}
+	}
+}
+
+// SensitiveValues 返回预置文件中的所有敏感值，包括镜像仓库认证信息和 kubeconfig 中的令牌、密码、私钥等
+func (p Preset) SensitiveValues() (out []string) {
+	for _, auth := range p.Dockerconfig.Auths {
+		if auth.Auth == "" {
+			continue
+		}
+		out = append(out, auth.Auth)
+		// auth 为 base64 编码的 "USERNAME:PASSWORD"
+		if buf, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil {
+			if splits := strings.SplitN(string(buf), ":", 2); len(splits) == 2 {
+				out = append(out, splits[1])
+			}
+		}
+	}
+	collectSensitiveKubeconfig(p.Kubeconfig, &out)
+	return
+}
+
+// RegisterSensitive 登记预置文件中的所有敏感值到日志脱敏
+func (p Preset) RegisterSensitive() {
+	redact.Add(p.SensitiveValues()...)
 }
 
 func (p Preset) GenerateKubeconfig() []byte {
@@ -80,6 +166,9 @@ func (p Preset) GenerateFiles() (dcDir string, kcFile string, err error) {
 	); err != nil {
 		return
 	}
+	if err = os.Chmod(dcFile, 0600); err != nil {
+		return
+	}
 	log.Printf("生成 Docker 配置文件: %s", dcFile)
 	if kcFile, err = tempfile.WriteFile(
 		p.GenerateKubeconfig(),
@@ -89,6 +178,21 @@ func (p Preset) GenerateFiles() (dcDir string, kcFile string, err error) {
 	); err != nil {
 		return
 	}
+	if err = os.Chmod(kcFile, 0600); err != nil {
+		return
+	}
 	log.Printf("生成 Kubeconfig 文件: %s", kcFile)
 	return
 }
+
+// presetKubeconfig 加载集群预置文件，并生成 kubeconfig 文件
+func presetKubeconfig(cluster string) (kcFile string, err error) {
+	var p Preset
+	if err = LoadPresetFromHome(cluster, &p); err != nil {
+		return
+	}
+	if _, kcFile, err = p.GenerateFiles(); err != nil {
+		return
+	}
+	return
+}
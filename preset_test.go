@@ -1 +1,52 @@
 package main
+
+import (
+	"github.com/acicn/deployer2/pkg/cmds"
+	"github.com/acicn/deployer2/pkg/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const (
+	testPreset = `
+registry: registry.example.com/hello
+kubeconfig:
+  apiVersion: v1
+  users:
+    - name: deployer
+      user:
+        token: kube-s3cr3t-token
+dockerconfig:
+  auths:
+    registry.example.com:
+      auth: ZGVwbG95ZXI6ZG9ja2VyLXMzY3IzdA==
+timeouts:
+  push: 20m
+retries:
+  push: 5
+`
+)
+
+func TestPreset_SensitiveValues(t *testing.T) {
+	defer redact.Reset()
+	var p Preset
+	err := LoadPreset([]byte(testPreset), &p)
+	require.NoError(t, err)
+	values := p.SensitiveValues()
+	assert.Contains(t, values, "kube-s3cr3t-token")
+	assert.Contains(t, values, "ZGVwbG95ZXI6ZG9ja2VyLXMzY3IzdA==")
+	assert.Contains(t, values, "docker-s3cr3t")
+	assert.Equal(t, "token: "+redact.Mask, redact.String("token: kube-s3cr3t-token"))
+}
+
+func TestPreset_TimeoutsAndRetries(t *testing.T) {
+	defer redact.Reset()
+	var p Preset
+	err := LoadPreset([]byte(testPreset), &p)
+	require.NoError(t, err)
+	assert.Equal(t, Timeouts{Push: "20m"}, p.Timeouts)
+	assert.Equal(t, PresetRetries{Push: 5}, p.Retries)
+	assert.Equal(t, 5, cmds.DefaultRetryPolicy.WithAttempts(p.Retries.Push).Attempts)
+	assert.Equal(t, 3, cmds.DefaultRetryPolicy.WithAttempts(p.Retries.Deploy).Attempts)
+}
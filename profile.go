@@ -2,31 +2,271 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/acicn/deployer2/pkg/buildcache"
+	"github.com/acicn/deployer2/pkg/redact"
+	"github.com/acicn/deployer2/pkg/secrets"
 	"github.com/acicn/deployer2/pkg/tmplfuncs"
 	"github.com/guoyk93/tempfile"
+	"github.com/imdario/mergo"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 )
 
+// ProfileBuilderIsolation 构建容器的隔离配置，默认不使用主机的网络、PID、IPC 命名空间，并以当前用户身份执行
+type ProfileBuilderIsolation struct {
+	// Network 容器网络，可以为 bridge (默认), host, none, allowlist
+	Network string `yaml:"network"`
+	// Allowlist 网络白名单，仅在 network 为 allowlist 时有效
+	Allowlist []string `yaml:"allowlist"`
+	HostPID   bool     `yaml:"hostPID"`
+	HostIPC   bool     `yaml:"hostIPC"`
+	// Root 使用 root 身份执行，并在执行后修正工作目录权限
+	Root      bool   `yaml:"root"`
+	ReadOnly  bool   `yaml:"readOnly"`
+	CPUs      string `yaml:"cpus"`
+	Memory    string `yaml:"memory"`
+	PidsLimit int    `yaml:"pidsLimit"`
+}
+
+// ProfileBuilderCache 构建缓存，兼容旧格式，即直接使用字符串表示容器内路径
+type ProfileBuilderCache struct {
+	Path string `yaml:"path"`
+	// Lock 锁模式，可以为 exclusive (默认), shared, none, snapshot
+	Lock string `yaml:"lock"`
+}
+
+func (c *ProfileBuilderCache) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var path string
+	if err = unmarshal(&path); err == nil {
+		c.Path = path
+		return
+	}
+	type plain ProfileBuilderCache
+	if err = unmarshal((*plain)(c)); err != nil {
+		return
+	}
+	err = buildcache.ValidateLockMode(c.Lock)
+	return
+}
+
+// ProfileBuilderRemoteCache 远程缓存，缓存键由缓存组，缓存路径和 keyFiles 的内容哈希组成
+type ProfileBuilderRemoteCache struct {
+	// KeyFiles 用于计算缓存键的文件，相对于工作目录的 glob 模式，比如 package-lock.json
+	KeyFiles []string `yaml:"keyFiles"`
+}
+
 type ProfileBuilder struct {
-	Image      string   `yaml:"image"`
-	CacheGroup string   `yaml:"cacheGroup"`
-	Caches     []string `yaml:"caches"`
+	Image      string                `yaml:"image"`
+	CacheGroup string                `yaml:"cacheGroup"`
+	Caches     []ProfileBuilderCache `yaml:"caches"`
+	// LockTimeout 等待缓存锁的超时时间，默认为 30m
+	LockTimeout string `yaml:"lockTimeout"`
+	// RemoteCache 远程缓存，需要管理员配置 $HOME/.deployer2/cache.yml
+	RemoteCache ProfileBuilderRemoteCache `yaml:"remoteCache"`
+	Isolation   ProfileBuilderIsolation   `yaml:"isolation"`
+	Env         map[string]string         `yaml:"env"`
+	Volumes     []string                  `yaml:"volumes"`
+	Workdir     string                    `yaml:"workdir"`
+	Shell       string                    `yaml:"shell"`
+	User        string                    `yaml:"user"`
+}
+
+// ProfileBuildStep 构建步骤，builder 字段缺失的值从环境配置的 builder 字段中获取
+type ProfileBuildStep struct {
+	Name    string         `yaml:"name"`
+	Builder ProfileBuilder `yaml:"builder"`
+	// When 执行条件，使用模板语言，渲染结果为空, false, 0, no 时跳过该步骤
+	When   string   `yaml:"when"`
+	Script []string `yaml:"script"`
+}
+
+// ProfileBuild 构建配置，兼容旧格式，即直接使用数组格式的单个构建脚本
+type ProfileBuild []ProfileBuildStep
+
+func (b *ProfileBuild) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var lines []string
+	if err = unmarshal(&lines); err == nil {
+		*b = ProfileBuild{{Script: lines}}
+		return
+	}
+	var steps []ProfileBuildStep
+	if err = unmarshal(&steps); err != nil {
+		return
+	}
+	*b = steps
+	return
+}
+
+// BuildStep 渲染完成的构建步骤
+type BuildStep struct {
+	Name    string
+	Builder ProfileBuilder
+	File    string
+}
+
+// ProfilePackageSecret Docker 构建秘密，通过 BuildKit 的 --secret 参数传递，不会进入镜像层
+type ProfilePackageSecret struct {
+	ID     string `yaml:"id"`
+	Src    string `yaml:"src"`
+	Env    string `yaml:"env"`
+	Secret string `yaml:"secret"`
+}
+
+// ProfilePackage 打包配置，兼容旧格式，即直接使用数组格式的 Dockerfile
+type ProfilePackage struct {
+	Dockerfile []string               `yaml:"dockerfile"`
+	Secrets    []ProfilePackageSecret `yaml:"secrets"`
+	SSH        []string               `yaml:"ssh"`
+}
+
+func (p *ProfilePackage) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var lines []string
+	if err = unmarshal(&lines); err == nil {
+		p.Dockerfile = lines
+		return
+	}
+	type plain ProfilePackage
+	err = unmarshal((*plain)(p))
+	return
+}
+
+// ProfileSecret 秘密值的来源，只能设置其中一个字段
+type ProfileSecret struct {
+	File       string `yaml:"file"`
+	Vault      string `yaml:"vault"`
+	Kubernetes string `yaml:"kubernetes"`
+}
+
+func (s ProfileSecret) Source() (kind string, ref string, err error) {
+	var count int
+	if s.File != "" {
+		kind, ref = "file", s.File
+		count++
+	}
+	if s.Vault != "" {
+		kind, ref = "vault", s.Vault
+		count++
+	}
+	if s.Kubernetes != "" {
+		kind, ref = "kubernetes", s.Kubernetes
+		count++
+	}
+	if count != 1 {
+		err = errors.New("秘密值必须且只能设置 file, vault, kubernetes 其中之一")
+		return
+	}
+	return
+}
+
+// ProfileArtifacts 构建产物，兼容直接使用数组格式的 glob 模式列表
+type ProfileArtifacts struct {
+	// Paths 相对于工作目录的 glob 模式，支持 ** 匹配多级目录
+	Paths []string `yaml:"paths"`
+	// Dir 输出目录，相对于工作目录，默认为 $HOME/.deployer2-artifacts/{镜像名}
+	Dir string `yaml:"dir"`
+	// Attach 是否将构建产物作为 OCI 制品附加到推送的镜像上
+	Attach bool `yaml:"attach"`
+}
+
+func (a *ProfileArtifacts) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var paths []string
+	if err = unmarshal(&paths); err == nil {
+		a.Paths = paths
+		return
+	}
+	type plain ProfileArtifacts
+	err = unmarshal((*plain)(a))
+	return
+}
+
+// ProfileSensitive 标记为敏感的变量，其值会在日志中被隐藏
+type ProfileSensitive struct {
+	Vars []string `yaml:"vars"`
+	Env  []string `yaml:"env"`
 }
 
 type Profile struct {
-	Profile  string                 `yaml:"-"`
-	Resource UniversalResourceList  `yaml:"resource"`
-	Check    UniversalCheck         `yaml:"check"`
-	Build    []string               `yaml:"build"`
-	Builder  ProfileBuilder         `yaml:"builder"`
-	Package  []string               `yaml:"package"`
-	Vars     map[string]interface{} `yaml:"vars"`
+	Profile    string                   `yaml:"-"`
+	Resource   UniversalResourceList    `yaml:"resource"`
+	Check      UniversalCheck           `yaml:"check"`
+	Ports      UniversalPorts           `yaml:"ports"`
+	Env        UniversalEnv             `yaml:"env"`
+	Command    []string                 `yaml:"command"`
+	Args       []string                 `yaml:"args"`
+	PreStop    *UniversalPreStop        `yaml:"preStop"`
+	Replicas   *int                     `yaml:"replicas"`
+	Autoscale  *UniversalAutoscale      `yaml:"autoscale"`
+	Scheduling UniversalScheduling      `yaml:"scheduling"`
+	Volumes    UniversalVolumes         `yaml:"volumes"`
+	Configs    []UniversalConfig        `yaml:"configs"`
+	Service    *UniversalService        `yaml:"service"`
+	Ingress    *UniversalIngress        `yaml:"ingress"`
+	Manifests  []UniversalManifest      `yaml:"manifests"`
+	Build      ProfileBuild             `yaml:"build"`
+	Builder    ProfileBuilder           `yaml:"builder"`
+	Package    ProfilePackage           `yaml:"package"`
+	Artifacts  ProfileArtifacts         `yaml:"artifacts"`
+	Timeouts   Timeouts                 `yaml:"timeouts"`
+	Vars       map[string]interface{}   `yaml:"vars"`
+	Workloads  UniversalWorkloads       `yaml:"workloads"`
+	Paths      []string                 `yaml:"paths"`
+	Secrets    map[string]ProfileSecret `yaml:"secrets"`
+	Sensitive  ProfileSensitive         `yaml:"sensitive"`
+
+	// SecretValues 已经加载的秘密值，用于渲染 .Secrets
+	SecretValues map[string]string `yaml:"-"`
+}
+
+// LoadSecrets 从外部存储加载 secrets 字段声明的所有秘密值，并登记到日志脱敏
+func (p *Profile) LoadSecrets(ctx context.Context, providers map[string]secrets.Provider) (err error) {
+	p.SecretValues = map[string]string{}
+	for name, secret := range p.Secrets {
+		var kind, ref string
+		if kind, ref, err = secret.Source(); err != nil {
+			err = fmt.Errorf("秘密值 %s: %s", name, err.Error())
+			return
+		}
+		provider, ok := providers[kind]
+		if !ok {
+			err = fmt.Errorf("秘密值 %s: 不支持的来源 %s", name, kind)
+			return
+		}
+		var v string
+		if v, err = provider.Get(ctx, ref); err != nil {
+			err = fmt.Errorf("秘密值 %s: %s", name, err.Error())
+			return
+		}
+		redact.Add(v)
+		p.SecretValues[name] = v
+		log.Printf("加载秘密值: %s (%s)", name, kind)
+	}
+	return
+}
+
+// RegisterSensitive 登记 sensitive 字段标记的变量值到日志脱敏
+func (p *Profile) RegisterSensitive() {
+	for _, name := range p.Sensitive.Vars {
+		if v, ok := p.Vars[name]; ok && v != nil {
+			redact.Add(fmt.Sprint(v))
+		}
+	}
+	for _, name := range p.Sensitive.Env {
+		redact.Add(os.Getenv(name))
+	}
 }
 
 func (p *Profile) Render(src string) (out []byte, err error) {
+	return p.RenderWith(src, nil)
+}
+
+// RenderWith 渲染模板，extra 为额外的模板数据，比如 manifests 字段中使用的 .Workload 和 .Image
+func (p *Profile) RenderWith(src string, extra map[string]interface{}) (out []byte, err error) {
 	var tmpl *template.Template
 	if tmpl, err = template.New("").
 		Option("missingkey=zero").
@@ -45,6 +285,10 @@ func (p *Profile) Render(src string) (out []byte, err error) {
 		"Env":     envs,
 		"Vars":    p.Vars,
 		"Profile": p.Profile,
+		"Secrets": p.SecretValues,
+	}
+	for k, v := range extra {
+		data[k] = v
 	}
 
 	buf := &bytes.Buffer{}
@@ -55,10 +299,75 @@ func (p *Profile) Render(src string) (out []byte, err error) {
 	return
 }
 
-func (p *Profile) GenerateBuild() ([]byte, error) {
+func (p *Profile) RenderString(src string) (string, error) {
+	out, err := p.Render(src)
+	return string(out), err
+}
+
+// GenerateBuilder 渲染构建容器配置中的 env, volumes, workdir, shell, user，volumes 中的相对路径相对于 dir
+func (p *Profile) GenerateBuilder(src ProfileBuilder, dir string) (b ProfileBuilder, err error) {
+	b = src
+	b.Env = map[string]string{}
+	for k, v := range src.Env {
+		if b.Env[k], err = p.RenderString(v); err != nil {
+			return
+		}
+	}
+	b.Volumes = nil
+	for _, v := range src.Volumes {
+		if v, err = p.RenderString(v); err != nil {
+			return
+		}
+		splits := strings.SplitN(v, ":", 2)
+		if len(splits) != 2 {
+			err = fmt.Errorf("builder.volumes 格式不正确，应为 \"HOST:CONTAINER[:ro]\": %s", v)
+			return
+		}
+		if strings.HasPrefix(splits[0], "~/") {
+			var home string
+			if home, err = os.UserHomeDir(); err != nil {
+				return
+			}
+			splits[0] = filepath.Join(home, strings.TrimPrefix(splits[0], "~/"))
+		} else if !filepath.IsAbs(splits[0]) {
+			splits[0] = filepath.Join(dir, splits[0])
+		}
+		b.Volumes = append(b.Volumes, splits[0]+":"+splits[1])
+	}
+	if b.Workdir, err = p.RenderString(src.Workdir); err != nil {
+		return
+	}
+	if b.Shell, err = p.RenderString(src.Shell); err != nil {
+		return
+	}
+	if b.User, err = p.RenderString(src.User); err != nil {
+		return
+	}
+	return
+}
+
+// GenerateBuildWhen 渲染构建步骤的执行条件
+func (p *Profile) GenerateBuildWhen(step ProfileBuildStep) (ok bool, err error) {
+	if strings.TrimSpace(step.When) == "" {
+		ok = true
+		return
+	}
+	var out string
+	if out, err = p.RenderString(step.When); err != nil {
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(out)) {
+	case "", "false", "0", "no", "<no value>":
+	default:
+		ok = true
+	}
+	return
+}
+
+func (p *Profile) GenerateBuild(step ProfileBuildStep) ([]byte, error) {
 	s := &strings.Builder{}
 	s.WriteString("#!/bin/bash\nset -eux\n")
-	for _, l := range p.Build {
+	for _, l := range step.Script {
 		s.WriteString(l)
 		s.WriteRune('\n')
 	}
@@ -66,7 +375,53 @@ func (p *Profile) GenerateBuild() ([]byte, error) {
 }
 
 func (p *Profile) GeneratePackage() ([]byte, error) {
-	return p.Render(strings.Join(p.Package, "\n"))
+	return p.Render(strings.Join(p.Package.Dockerfile, "\n"))
+}
+
+// GenerateBuildSecrets 生成 docker build --secret 参数，引用 secrets 字段的构建秘密会写入临时文件
+func (p *Profile) GenerateBuildSecrets() (out []string, err error) {
+	for _, secret := range p.Package.Secrets {
+		if secret.ID == "" {
+			err = errors.New("构建秘密缺少 id 字段")
+			return
+		}
+		var sources []string
+		if secret.Src != "" {
+			src := secret.Src
+			if strings.HasPrefix(src, "~/") {
+				var home string
+				if home, err = os.UserHomeDir(); err != nil {
+					return
+				}
+				src = filepath.Join(home, strings.TrimPrefix(src, "~/"))
+			}
+			sources = append(sources, "src="+src)
+		}
+		if secret.Env != "" {
+			sources = append(sources, "env="+secret.Env)
+		}
+		if secret.Secret != "" {
+			v, ok := p.SecretValues[secret.Secret]
+			if !ok {
+				err = fmt.Errorf("构建秘密 %s 引用了不存在的秘密值 %s", secret.ID, secret.Secret)
+				return
+			}
+			var file string
+			if file, err = tempfile.WriteFile([]byte(v), "deployer-build-secret", "", false); err != nil {
+				return
+			}
+			if err = os.Chmod(file, 0600); err != nil {
+				return
+			}
+			sources = append(sources, "src="+file)
+		}
+		if len(sources) != 1 {
+			err = fmt.Errorf("构建秘密 %s 必须且只能设置 src, env, secret 其中之一", secret.ID)
+			return
+		}
+		out = append(out, "id="+secret.ID+","+sources[0])
+	}
+	return
 }
 
 func (p *Profile) PrintGeneratedContent(name string, content string) {
@@ -84,14 +439,43 @@ func (p *Profile) PrintGeneratedContent(name string, content string) {
 	}
 }
 
-func (p *Profile) GenerateFiles() (buildFile string, packageFile string, err error) {
+// GenerateFiles 渲染并写入所有构建步骤的脚本和打包脚本，跳过不满足执行条件的构建步骤
+func (p *Profile) GenerateFiles() (steps []BuildStep, packageFile string, err error) {
 	var buf []byte
-	if buf, err = p.GenerateBuild(); err != nil {
-		return
-	}
-	p.PrintGeneratedContent("构建脚本", string(buf))
-	if buildFile, err = tempfile.WriteFile(buf, "deployer-build", ".sh", true); err != nil {
-		return
+	for i, step := range p.Build {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step-%d", i+1)
+		}
+		var ok bool
+		if ok, err = p.GenerateBuildWhen(step); err != nil {
+			return
+		}
+		if !ok {
+			log.Printf("跳过构建步骤 [%s]: 不满足执行条件 %s", name, step.When)
+			continue
+		}
+		builder := step.Builder
+		if err = mergo.Merge(&builder, p.Builder); err != nil {
+			return
+		}
+		if buf, err = p.GenerateBuild(step); err != nil {
+			return
+		}
+		if len(p.Build) > 1 || step.Name != "" {
+			p.PrintGeneratedContent("构建脚本 ["+name+"]", string(buf))
+		} else {
+			p.PrintGeneratedContent("构建脚本", string(buf))
+		}
+		// 生成的文件可能包含秘密值，写入仅允许当前用户访问的目录；文件本身保持可读，以便以其他用户身份运行的构建容器通过只读挂载读取
+		var dir, file string
+		if dir, file, err = tempfile.WriteDirFile(buf, "deployer-build", "build.sh", false); err != nil {
+			return
+		}
+		if err = os.Chmod(dir, 0700); err != nil {
+			return
+		}
+		steps = append(steps, BuildStep{Name: name, Builder: builder, File: file})
 	}
 	if buf, err = p.GeneratePackage(); err != nil {
 		return
@@ -100,5 +484,8 @@ func (p *Profile) GenerateFiles() (buildFile string, packageFile string, err err
 	if packageFile, err = tempfile.WriteFile(buf, "deployer-package", ".dockerfile", false); err != nil {
 		return
 	}
+	if err = os.Chmod(packageFile, 0600); err != nil {
+		return
+	}
 	return
 }
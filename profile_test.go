@@ -1 +1,213 @@
 package main
+
+import (
+	"context"
+	"errors"
+	"github.com/acicn/deployer2/pkg/redact"
+	"github.com/acicn/deployer2/pkg/secrets"
+	"github.com/guoyk93/tempfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+type testSecretProvider map[string]string
+
+func (t testSecretProvider) Get(ctx context.Context, ref string) (string, error) {
+	if v, ok := t[ref]; ok {
+		return v, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestProfile_LoadSecrets(t *testing.T) {
+	defer redact.Reset()
+	p := Profile{
+		Secrets: map[string]ProfileSecret{
+			"npm_token": {Vault: "secret/data/npm#token"},
+		},
+		Build: ProfileBuild{{Script: []string{"echo {{.Secrets.npm_token}}"}}},
+	}
+	err := p.LoadSecrets(context.Background(), map[string]secrets.Provider{
+		"vault": testSecretProvider{"secret/data/npm#token": "npm-s3cr3t"},
+	})
+	require.NoError(t, err)
+	buf, err := p.GenerateBuild(p.Build[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), "echo npm-s3cr3t")
+	assert.Equal(t, "echo "+redact.Mask, redact.String("echo npm-s3cr3t"))
+
+	p.Secrets["other"] = ProfileSecret{File: "a", Vault: "b"}
+	assert.Error(t, p.LoadSecrets(context.Background(), map[string]secrets.Provider{}))
+}
+
+func TestProfilePackage_UnmarshalYAML(t *testing.T) {
+	var m Manifest
+	err := LoadManifest([]byte(`
+version: 2
+default:
+  package:
+    - FROM nginx
+prod:
+  package:
+    dockerfile:
+      - FROM node
+      - RUN --mount=type=secret,id=npmrc npm install
+    secrets:
+      - id: npmrc
+        src: /home/jenkins/.npmrc
+      - id: token
+        env: NPM_TOKEN
+    ssh:
+      - default
+`), &m)
+	require.NoError(t, err)
+	p, err := m.Profile("dev")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"FROM nginx"}, p.Package.Dockerfile)
+
+	p, err = m.Profile("prod")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default"}, p.Package.SSH)
+	args, err := p.GenerateBuildSecrets()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id=npmrc,src=/home/jenkins/.npmrc", "id=token,env=NPM_TOKEN"}, args)
+
+	p.Package.Secrets = []ProfilePackageSecret{{ID: "missing", Secret: "missing"}}
+	_, err = p.GenerateBuildSecrets()
+	assert.Error(t, err)
+}
+
+func TestProfile_GenerateBuilder(t *testing.T) {
+	p := Profile{
+		Profile: "prod",
+		Vars:    map[string]interface{}{"env": "production"},
+		Builder: ProfileBuilder{
+			Image:   "acicn/jdk-builder:8",
+			Env:     map[string]string{"SPRING_PROFILE": "{{.Vars.env}}"},
+			Volumes: []string{"config/settings.xml:/root/.m2/settings.xml:ro", "/opt/tools:/opt/tools"},
+			Workdir: "backend-{{.Profile}}",
+			Shell:   "sh",
+		},
+	}
+	b, err := p.GenerateBuilder(p.Builder, "/data/workspace/hello")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"SPRING_PROFILE": "production"}, b.Env)
+	assert.Equal(t, []string{
+		"/data/workspace/hello/config/settings.xml:/root/.m2/settings.xml:ro",
+		"/opt/tools:/opt/tools",
+	}, b.Volumes)
+	assert.Equal(t, "backend-prod", b.Workdir)
+	assert.Equal(t, "sh", b.Shell)
+
+	p.Builder.Volumes = []string{"invalid"}
+	_, err = p.GenerateBuilder(p.Builder, "/data/workspace/hello")
+	assert.Error(t, err)
+}
+
+func TestProfileBuild_UnmarshalYAML(t *testing.T) {
+	defer tempfile.DeleteAll()
+	var m Manifest
+	err := LoadManifest([]byte(`
+version: 2
+default:
+  builder:
+    image: acicn/node-builder:12
+    cacheGroup: hello
+  build:
+    - name: frontend
+      script:
+        - npm run build
+    - name: backend
+      builder:
+        image: acicn/jdk-builder:8
+        caches:
+          - /root/.m2
+      script:
+        - mvn package
+    - name: compress
+      when: '{{eq .Profile "prod"}}'
+      script:
+        - gzip -r dist
+dev:
+  vars:
+    hello: world
+legacy:
+  build:
+    - echo hello
+`), &m)
+	require.NoError(t, err)
+
+	p, err := m.Profile("legacy")
+	require.NoError(t, err)
+	require.Len(t, p.Build, 1)
+	assert.Equal(t, []string{"echo hello"}, p.Build[0].Script)
+
+	p, err = m.Profile("dev")
+	require.NoError(t, err)
+	steps, _, err := p.GenerateFiles()
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	assert.Equal(t, "frontend", steps[0].Name)
+	assert.Equal(t, "acicn/node-builder:12", steps[0].Builder.Image)
+	assert.Equal(t, "backend", steps[1].Name)
+	assert.Equal(t, "acicn/jdk-builder:8", steps[1].Builder.Image)
+	assert.Equal(t, "hello", steps[1].Builder.CacheGroup)
+	assert.Equal(t, []ProfileBuilderCache{{Path: "/root/.m2"}}, steps[1].Builder.Caches)
+
+	p, err = m.Profile("prod")
+	require.NoError(t, err)
+	ok, err := p.GenerateBuildWhen(p.Build[2])
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestProfileBuilderCache_UnmarshalYAML(t *testing.T) {
+	var b ProfileBuilder
+	err := yaml.UnmarshalStrict([]byte(`
+caches:
+  - /root/.npm
+  - path: /root/.m2
+    lock: shared
+lockTimeout: 10m
+`), &b)
+	require.NoError(t, err)
+	assert.Equal(t, []ProfileBuilderCache{
+		{Path: "/root/.npm"},
+		{Path: "/root/.m2", Lock: "shared"},
+	}, b.Caches)
+	assert.Equal(t, "10m", b.LockTimeout)
+
+	err = yaml.UnmarshalStrict([]byte(`
+caches:
+  - path: /root/.m2
+    lock: bad
+`), &b)
+	assert.Error(t, err)
+}
+
+func TestProfileArtifacts_UnmarshalYAML(t *testing.T) {
+	var m Manifest
+	err := LoadManifest([]byte(`
+version: 2
+default:
+  artifacts:
+    - target/surefire-reports/*.xml
+    - coverage.out
+prod:
+  artifacts:
+    paths:
+      - bin/app
+    dir: out
+    attach: true
+`), &m)
+	require.NoError(t, err)
+	p, err := m.Profile("dev")
+	require.NoError(t, err)
+	assert.Equal(t, ProfileArtifacts{Paths: []string{"target/surefire-reports/*.xml", "coverage.out"}}, p.Artifacts)
+
+	p, err = m.Profile("prod")
+	require.NoError(t, err)
+	assert.Equal(t, ProfileArtifacts{Paths: []string{"bin/app"}, Dir: "out", Attach: true}, p.Artifacts)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/acicn/deployer2/pkg/buildcache"
+	"github.com/acicn/deployer2/pkg/cmds"
+	"github.com/acicn/deployer2/pkg/redact"
+	"github.com/acicn/deployer2/pkg/remotecache"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RemoteCacheConfig 远程缓存配置，由管理员保存在 $HOME/.deployer2/cache.yml
+type RemoteCacheConfig struct {
+	// Type 存储类型，可以为 local, s3
+	Type string `yaml:"type"`
+	// Dir 本地目录，比如 NFS 挂载的共享目录，仅在 type 为 local 时有效
+	Dir string `yaml:"dir"`
+	S3  struct {
+		Endpoint  string `yaml:"endpoint"`
+		Region    string `yaml:"region"`
+		Bucket    string `yaml:"bucket"`
+		Prefix    string `yaml:"prefix"`
+		AccessKey string `yaml:"accessKey"`
+		SecretKey string `yaml:"secretKey"`
+	} `yaml:"s3"`
+}
+
+func (c RemoteCacheConfig) Backend() (b remotecache.Backend, err error) {
+	switch c.Type {
+	case "local":
+		if c.Dir == "" {
+			err = errors.New("远程缓存配置缺少 dir 字段")
+			return
+		}
+		b = &remotecache.LocalBackend{Dir: c.Dir}
+	case "s3":
+		if c.S3.Endpoint == "" || c.S3.Bucket == "" {
+			err = errors.New("远程缓存配置缺少 s3.endpoint 或者 s3.bucket 字段")
+			return
+		}
+		redact.Add(c.S3.SecretKey)
+		b = &remotecache.S3Backend{
+			Endpoint:  c.S3.Endpoint,
+			Region:    c.S3.Region,
+			Bucket:    c.S3.Bucket,
+			Prefix:    c.S3.Prefix,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+		}
+	default:
+		err = fmt.Errorf("不支持的远程缓存类型: %s", c.Type)
+	}
+	return
+}
+
+// LoadRemoteCacheBackendFromHome 从 $HOME/.deployer2/cache.yml 加载远程缓存存储，文件不存在时返回 nil
+func LoadRemoteCacheBackendFromHome() (b remotecache.Backend, err error) {
+	var home string
+	if home, err = os.UserHomeDir(); err != nil {
+		return
+	}
+	filename := filepath.Join(home, ".deployer2", "cache.yml")
+	var buf []byte
+	if buf, err = ioutil.ReadFile(filename); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var c RemoteCacheConfig
+	if err = yaml.UnmarshalStrict(buf, &c); err != nil {
+		return
+	}
+	log.Printf("加载远程缓存配置: %s", filename)
+	return c.Backend()
+}
+
+type remoteCacheEntry struct {
+	Key string
+	Dir string
+}
+
+// restoreRemoteCaches 从远程缓存恢复本地没有的缓存，返回需要在构建成功后上传的缓存，远程缓存的错误不会中断构建
+func restoreRemoteCaches(ctx context.Context, b remotecache.Backend, opts cmds.DockerRunOptions, group string, workspace string, keyFiles []string) (pending []remoteCacheEntry) {
+	for _, cache := range opts.Caches {
+		if ctx.Err() != nil {
+			return
+		}
+		if cache.Lock == buildcache.LockSnapshot {
+			continue
+		}
+		dir := opts.CacheHostDir(cache)
+		key, err := remotecache.Key(group, cache.Path, workspace, keyFiles)
+		if err != nil {
+			log.Printf("跳过远程缓存 %s: %s", cache.Path, err.Error())
+			continue
+		}
+		if buildcache.ReadMeta(dir).RemoteKey == key {
+			log.Printf("本地缓存 %s 已经与远程缓存 %s 一致", cache.Path, key)
+			continue
+		}
+		ok, err := restoreRemoteCache(ctx, b, key, dir, opts.LockTimeout)
+		if err != nil {
+			log.Printf("恢复远程缓存 %s 失败: %s", key, err.Error())
+			continue
+		}
+		if ok {
+			log.Printf("恢复远程缓存: %s -> %s", key, cache.Path)
+		} else {
+			log.Printf("远程缓存 %s 不存在，将在构建成功后上传", key)
+			pending = append(pending, remoteCacheEntry{Key: key, Dir: dir})
+		}
+	}
+	return
+}
+
+func restoreRemoteCache(ctx context.Context, b remotecache.Backend, key string, dir string, timeout time.Duration) (ok bool, err error) {
+	var unlock func()
+	if unlock, err = buildcache.Lock(ctx, dir, false, timeout); err != nil {
+		return
+	}
+	defer unlock()
+	if ok, err = remotecache.Restore(ctx, b, key, dir); err != nil || !ok {
+		return
+	}
+	err = buildcache.SetRemoteKey(dir, key)
+	return
+}
+
+// saveRemoteCaches 上传缓存到远程缓存，错误不会中断构建
+func saveRemoteCaches(ctx context.Context, b remotecache.Backend, pending []remoteCacheEntry, timeout time.Duration) {
+	for _, entry := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := saveRemoteCache(ctx, b, entry.Key, entry.Dir, timeout); err != nil {
+			log.Printf("上传远程缓存 %s 失败: %s", entry.Key, err.Error())
+			continue
+		}
+		log.Printf("上传远程缓存: %s", entry.Key)
+	}
+}
+
+func saveRemoteCache(ctx context.Context, b remotecache.Backend, key string, dir string, timeout time.Duration) (err error) {
+	// 只在打包时持有锁，上传可能耗时很久，不应该阻塞其他任务使用缓存
+	var unlock func()
+	if unlock, err = buildcache.Lock(ctx, dir, true, timeout); err != nil {
+		return
+	}
+	var f *os.File
+	var size int64
+	f, size, err = remotecache.Pack(dir)
+	unlock()
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = b.Put(ctx, key, f, size); err != nil {
+		return
+	}
+	if unlock, err = buildcache.Lock(ctx, dir, true, timeout); err != nil {
+		return
+	}
+	defer unlock()
+	err = buildcache.SetRemoteKey(dir, key)
+	return
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/acicn/deployer2/pkg/artifacts"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	// ArtifactType 附加到镜像上的构建产物的 OCI 制品类型
+	ArtifactType = "application/vnd.acicn.deployer2.artifacts"
+)
+
+// StepReport 构建步骤的执行结果
+type StepReport struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// UnitReport 一个服务的执行结果
+type UnitReport struct {
+	Service      string               `json:"service,omitempty"`
+	Profile      string               `json:"profile"`
+	Image        string               `json:"image"`
+	Steps        []StepReport         `json:"steps"`
+	ArtifactsDir string               `json:"artifactsDir,omitempty"`
+	Artifacts    []artifacts.Artifact `json:"artifacts,omitempty"`
+	Error        string               `json:"error,omitempty"`
+}
+
+// RunReport 一次运行的报告，使用 --report 参数输出为 JSON 文件
+type RunReport struct {
+	Commit    string        `json:"commit,omitempty"`
+	StartedAt time.Time     `json:"startedAt"`
+	Units     []*UnitReport `json:"units"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func (r *RunReport) WriteFile(filename string) (err error) {
+	var buf []byte
+	if buf, err = json.MarshalIndent(r, "", "  "); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filename, buf, 0644)
+	return
+}
+
+// imageRepository 返回不包含标签的镜像名，用作默认构建产物输出目录
+func imageRepository(imageName string) string {
+	if i := strings.LastIndex(imageName, ":"); i >= 0 && !strings.Contains(imageName[i:], "/") {
+		return imageName[:i]
+	}
+	return imageName
+}
+
+// imageVersion 返回镜像标签，用作构建产物输出目录的版本名
+func imageVersion(imageName string) string {
+	if i := strings.LastIndex(imageName, ":"); i >= 0 && !strings.Contains(imageName[i:], "/") {
+		return imageName[i+1:]
+	}
+	return "latest"
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestImageVersion(t *testing.T) {
+	assert.Equal(t, "test-build-12", imageVersion("biz/app:test-build-12"))
+	assert.Equal(t, "test", imageVersion("registry:5000/biz/app:test"))
+	assert.Equal(t, "latest", imageVersion("registry:5000/biz/app"))
+}
+
+func TestImageRepository(t *testing.T) {
+	assert.Equal(t, "biz/app", imageRepository("biz/app:test-build-12"))
+	assert.Equal(t, "registry:5000/biz/app", imageRepository("registry:5000/biz/app:test"))
+	assert.Equal(t, "registry:5000/biz/app", imageRepository("registry:5000/biz/app"))
+}
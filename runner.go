@@ -0,0 +1,804 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/acicn/deployer2/pkg/allowproxy"
+	"github.com/acicn/deployer2/pkg/artifacts"
+	"github.com/acicn/deployer2/pkg/buildcache"
+	"github.com/acicn/deployer2/pkg/cmds"
+	"github.com/acicn/deployer2/pkg/image_tracker"
+	"github.com/acicn/deployer2/pkg/remotecache"
+	"github.com/acicn/deployer2/pkg/secrets"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// builderHome 以宿主机用户身份执行构建容器时，容器内默认的 $HOME
+const builderHome = "/tmp"
+
+// Unit 一次完整的 构建/打包/部署 流程，单仓库模式下只有一个，多服务模式下每个服务一个
+type Unit struct {
+	Service    string
+	Dir        string
+	Profile    Profile
+	ImageNames ImageNames
+	Workloads  UniversalWorkloads
+	// Report 执行结果，由 Runner.Run 创建
+	Report *UnitReport
+}
+
+type Runner struct {
+	IgnoreBuilder bool
+	SkipDeploy    bool
+	// CreateMissing 工作负载不存在时自动创建
+	CreateMissing bool
+	ImageTracker  image_tracker.ImageTracker
+	// RepoDir deployer.yml 所在目录，paths 字段相对于该目录
+	RepoDir string
+	// Commit 当前 Git 提交，部署成功后记录在工作负载注解中
+	Commit string
+	// Report 运行报告，可以为空
+	Report *RunReport
+}
+
+// Changed 对比工作负载注解中记录的上次部署的提交，判断 paths 字段匹配的文件是否有变化，无法判断时视为有变化
+func (r *Runner) Changed(ctx context.Context, u *Unit) (changed bool, err error) {
+	if len(u.Profile.Paths) == 0 || r.Commit == "" || len(u.Workloads) == 0 {
+		changed = true
+		return
+	}
+	commits := map[string]bool{}
+	for _, workload := range u.Workloads {
+		var preset Preset
+		if err = LoadPresetFromHome(workload.Cluster, &preset); err != nil {
+			return
+		}
+		var kcFile string
+		if _, kcFile, err = preset.GenerateFiles(); err != nil {
+			return
+		}
+		var buf []byte
+		if buf, err = r.kubectlGet(ctx, u, preset, kcFile, workload); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("无法获取工作负载 [%s]: %s", workload.String(), err.Error())
+			err = nil
+			changed = true
+			return
+		}
+		var obj struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err = json.Unmarshal(buf, &obj); err != nil {
+			return
+		}
+		commit := obj.Metadata.Annotations[AnnotationCommit]
+		if commit == "" {
+			log.Printf("工作负载 [%s] 没有记录上次部署的提交", workload.String())
+			changed = true
+			return
+		}
+		commits[commit] = true
+	}
+	for commit := range commits {
+		var files []string
+		if files, err = cmds.GitDiffNames(ctx, r.RepoDir, commit, r.Commit); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("无法对比提交 %s: %s", commit, err.Error())
+			err = nil
+			changed = true
+			return
+		}
+		if file, ok := MatchPaths(u.Profile.Paths, files); ok {
+			log.Printf("自提交 %s 以来，文件 %s 发生了变化", commit, file)
+			changed = true
+			return
+		}
+	}
+	return
+}
+
+// kubectlGet 使用 deploy 阶段的超时时间获取工作负载，环境配置的超时时间优先于集群预置文件
+func (r *Runner) kubectlGet(ctx context.Context, u *Unit, preset Preset, kcFile string, workload UniversalWorkload) (buf []byte, err error) {
+	var cancel context.CancelFunc
+	if ctx, cancel, err = withTimeout(ctx, "deploy", u.Profile.Timeouts.Merge(preset.Timeouts, DefaultTimeouts).Deploy); err != nil {
+		return
+	}
+	defer cancel()
+	return cmds.KubectlGet(ctx, kcFile, workload.Namespace, workload.Name, workload.Type)
+}
+
+func (r *Runner) Run(ctx context.Context, u *Unit) (err error) {
+	u.Report = &UnitReport{
+		Service: u.Service,
+		Profile: u.Profile.Profile,
+		Image:   u.ImageNames.Primary(),
+	}
+	if r.Report != nil {
+		r.Report.Units = append(r.Report.Units, u.Report)
+	}
+	defer func() {
+		if err != nil {
+			u.Report.Error = err.Error()
+		}
+	}()
+
+	if u.Service != "" {
+		log.Printf("------------ 服务 [%s] ------------", u.Service)
+		log.Printf("上下文目录: %s", u.Dir)
+	}
+
+	// 登记敏感变量，加载秘密值，用于渲染 .Secrets
+	u.Profile.RegisterSensitive()
+	if err = r.loadSecrets(ctx, u); err != nil {
+		return
+	}
+
+	var steps []BuildStep
+	var filePackage string
+	if steps, filePackage, err = u.Profile.GenerateFiles(); err != nil {
+		return
+	}
+	for _, step := range steps {
+		log.Printf("写入构建文件 [%s]: %s", step.Name, step.File)
+	}
+	log.Printf("写入打包文件: %s", filePackage)
+
+	// 依次执行构建步骤，无论成功与否都收集构建产物，以便保留失败的测试报告
+	err = r.buildSteps(ctx, u, steps)
+	if errCollect := r.collectArtifacts(u); errCollect != nil {
+		if err != nil {
+			log.Printf("收集构建产物失败: %s", errCollect.Error())
+		} else {
+			err = errCollect
+		}
+	}
+	if err != nil {
+		return
+	}
+	log.Println("构建完成")
+
+	// 执行打包脚本，即 docker build
+	log.Println("------------ 打包 ------------")
+	var buildSecrets []string
+	if buildSecrets, err = u.Profile.GenerateBuildSecrets(); err != nil {
+		return
+	}
+	if err = r.dockerBuild(ctx, u, filePackage, buildSecrets); err != nil {
+		return
+	}
+	log.Printf("打包完成: %s", u.ImageNames.Primary())
+
+	// 追踪涉及到的所有临时镜像，用来做事后清理
+	r.ImageTracker.Add(u.ImageNames.Primary())
+
+	// 遍历所有目标工作负载，执行推送/部署流程
+	for _, workload := range u.Workloads {
+		if err = r.deploy(ctx, u, workload); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *Runner) dockerBuild(ctx context.Context, u *Unit, filePackage string, buildSecrets []string) (err error) {
+	var cancel context.CancelFunc
+	if ctx, cancel, err = withTimeout(ctx, "package", u.Profile.Timeouts.Merge(DefaultTimeouts).Package); err != nil {
+		return
+	}
+	defer cancel()
+	return cmds.DockerBuild(ctx, filePackage, u.ImageNames.Primary(), u.Dir, cmds.DockerBuildOptions{
+		Secrets: buildSecrets,
+		SSH:     u.Profile.Package.SSH,
+	})
+}
+
+func (r *Runner) buildSteps(ctx context.Context, u *Unit, steps []BuildStep) (err error) {
+	for i, step := range steps {
+		if len(steps) > 1 {
+			log.Printf("------------ 构建步骤 [%d/%d] %s ------------", i+1, len(steps), step.Name)
+		}
+		start := time.Now()
+		err = r.build(ctx, u, step)
+		report := StepReport{Name: step.Name, Duration: time.Since(start)}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		u.Report.Steps = append(u.Report.Steps, report)
+		if err != nil {
+			log.Printf("构建步骤 [%s] 失败, 耗时 %s", step.Name, report.Duration.Round(time.Millisecond))
+			return
+		}
+		log.Printf("构建步骤 [%s] 完成, 耗时 %s", step.Name, report.Duration.Round(time.Millisecond))
+	}
+	if len(steps) > 1 {
+		for _, report := range u.Report.Steps {
+			log.Printf("  %s: %s", report.Name, report.Duration.Round(time.Millisecond))
+		}
+	}
+	return
+}
+
+// collectArtifacts 收集构建产物到 {dir}/{镜像标签} 目录
+func (r *Runner) collectArtifacts(u *Unit) (err error) {
+	if len(u.Profile.Artifacts.Paths) == 0 {
+		return
+	}
+	log.Println("------------ 收集构建产物 ------------")
+	root := u.Profile.Artifacts.Dir
+	if root == "" {
+		// 默认输出到上下文目录之外，避免构建产物进入 docker build 的上下文
+		var home string
+		if home, err = os.UserHomeDir(); err != nil {
+			return
+		}
+		root = filepath.Join(home, ".deployer2-artifacts", imageRepository(u.ImageNames.Primary()))
+	} else if !filepath.IsAbs(root) {
+		root = filepath.Join(u.Dir, root)
+	}
+	version := imageVersion(u.ImageNames.Primary())
+	if u.Report.Artifacts, err = artifacts.Collect(u.Dir, u.Profile.Artifacts.Paths, root, version); err != nil {
+		return
+	}
+	u.Report.ArtifactsDir = filepath.Join(root, version)
+	for _, a := range u.Report.Artifacts {
+		if a.JUnit != nil {
+			log.Printf("构建产物: %s (%s, 测试 %d, 失败 %d, 错误 %d, 跳过 %d)", a.Path, a.Kind, a.JUnit.Tests, a.JUnit.Failures, a.JUnit.Errors, a.JUnit.Skipped)
+		} else {
+			log.Printf("构建产物: %s (%s, %s)", a.Path, a.Kind, buildcache.FormatSize(a.Size))
+		}
+	}
+	if len(u.Report.Artifacts) == 0 {
+		log.Printf("没有找到匹配的构建产物: %s", strings.Join(u.Profile.Artifacts.Paths, ", "))
+		return
+	}
+	var buf []byte
+	if buf, err = json.MarshalIndent(u.Report.Artifacts, "", "  "); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(u.Report.ArtifactsDir, "artifacts.json"), buf, 0644); err != nil {
+		return
+	}
+	log.Printf("构建产物输出目录: %s", u.Report.ArtifactsDir)
+	return
+}
+
+func (r *Runner) loadSecrets(ctx context.Context, u *Unit) (err error) {
+	if len(u.Profile.Secrets) == 0 {
+		return
+	}
+	// 未指定集群的 Kubernetes 秘密，从第一个目标工作负载所在的集群读取，并使用该集群预置文件的超时时间
+	var cluster string
+	var preset Preset
+	if len(u.Workloads) > 0 {
+		cluster = u.Workloads[0].Cluster
+		if err = LoadPresetFromHome(cluster, &preset); err != nil {
+			return
+		}
+	}
+	var cancel context.CancelFunc
+	if ctx, cancel, err = withTimeout(ctx, "deploy", u.Profile.Timeouts.Merge(preset.Timeouts, DefaultTimeouts).Deploy); err != nil {
+		return
+	}
+	defer cancel()
+	err = u.Profile.LoadSecrets(ctx, map[string]secrets.Provider{
+		"file":  secrets.FileProvider{},
+		"vault": secrets.NewVaultProviderFromEnv(),
+		"kubernetes": &secrets.KubernetesProvider{
+			DefaultCluster: cluster,
+			Kubeconfig:     presetKubeconfig,
+		},
+	})
+	return
+}
+
+// build 执行单个构建步骤，每个步骤使用独立的 build 阶段超时时间
+func (r *Runner) build(ctx context.Context, u *Unit, step BuildStep) (err error) {
+	var cancel context.CancelFunc
+	if ctx, cancel, err = withTimeout(ctx, "build", u.Profile.Timeouts.Merge(DefaultTimeouts).Build); err != nil {
+		return
+	}
+	defer cancel()
+
+	if step.Builder.Image != "" && !r.IgnoreBuilder {
+		log.Println("------------ 使用容器构建 ------------")
+		cacheGroup := step.Builder.CacheGroup
+		if cacheGroup == "" {
+			cacheGroup = "default"
+		}
+		var cacheRoot string
+		if cacheRoot, err = buildcache.Root(); err != nil {
+			return
+		}
+		var builder ProfileBuilder
+		if builder, err = u.Profile.GenerateBuilder(step.Builder, u.Dir); err != nil {
+			return
+		}
+		isolation := builder.Isolation
+		opts := cmds.DockerRunOptions{
+			Image:     builder.Image,
+			CacheDir:  filepath.Join(cacheRoot, cacheGroup),
+			Workspace: u.Dir,
+			Script:    step.File,
+			HostPID:   isolation.HostPID,
+			HostIPC:   isolation.HostIPC,
+			ReadOnly:  isolation.ReadOnly,
+			CPUs:      isolation.CPUs,
+			Memory:    isolation.Memory,
+			PidsLimit: isolation.PidsLimit,
+			Volumes:   builder.Volumes,
+			Workdir:   builder.Workdir,
+			Shell:     builder.Shell,
+			User:      builder.User,
+		}
+		for _, cache := range builder.Caches {
+			opts.Caches = append(opts.Caches, cmds.DockerCache{Path: cache.Path, Lock: cache.Lock})
+		}
+		if builder.LockTimeout != "" {
+			if opts.LockTimeout, err = time.ParseDuration(builder.LockTimeout); err != nil {
+				return
+			}
+		}
+		var envKeys []string
+		for k := range builder.Env {
+			envKeys = append(envKeys, k)
+		}
+		sort.Strings(envKeys)
+		for _, k := range envKeys {
+			opts.Env = append(opts.Env, k+"="+builder.Env[k])
+		}
+		if opts.User == "" && !isolation.Root {
+			opts.User = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+			// 宿主机用户在构建镜像中通常不存在，$HOME 为 / 不可写
+			if _, ok := builder.Env["HOME"]; !ok {
+				opts.Env = append(opts.Env, "HOME="+builderHome)
+			}
+		}
+		switch isolation.Network {
+		case "", "bridge":
+		case "host", "none":
+			opts.Network = isolation.Network
+		case "allowlist":
+			var cleanup func()
+			if cleanup, err = r.setupAllowlist(ctx, &opts, isolation.Allowlist); err != nil {
+				return
+			}
+			defer cleanup()
+		default:
+			err = fmt.Errorf("不支持的构建容器网络: %s", isolation.Network)
+			return
+		}
+		// 从远程缓存恢复
+		var remoteCache remotecache.Backend
+		var pending []remoteCacheEntry
+		if len(builder.RemoteCache.KeyFiles) > 0 {
+			if remoteCache, err = LoadRemoteCacheBackendFromHome(); err != nil {
+				return
+			}
+			if remoteCache == nil {
+				log.Println("没有找到远程缓存配置 $HOME/.deployer2/cache.yml，跳过远程缓存")
+			} else {
+				pending = restoreRemoteCaches(ctx, remoteCache, opts, cacheGroup, u.Dir, builder.RemoteCache.KeyFiles)
+			}
+		}
+		if err = cmds.ExecuteInDocker(ctx, opts); err != nil {
+			return
+		}
+		// 构建成功后上传到远程缓存
+		if remoteCache != nil {
+			saveRemoteCaches(ctx, remoteCache, pending, opts.LockTimeout)
+		}
+	} else {
+		log.Println("------------ 构建 ------------")
+		if err = cmds.ExecuteInDir(ctx, u.Dir, "bash", step.File); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// setupAllowlist 创建无法访问外部网络的 Docker 网络，并在网关地址上启动白名单代理，构建容器只能通过代理访问白名单中的主机
+func (r *Runner) setupAllowlist(ctx context.Context, opts *cmds.DockerRunOptions, allowlist []string) (cleanup func(), err error) {
+	network := fmt.Sprintf("deployer2-allowlist-%d-%d", os.Getpid(), time.Now().UnixNano())
+	var gateway string
+	if gateway, err = cmds.DockerNetworkCreateInternal(ctx, network); err != nil {
+		return
+	}
+	var proxy *allowproxy.Proxy
+	if proxy, err = allowproxy.Start(net.JoinHostPort(gateway, "0"), allowlist); err != nil {
+		_ = removeDockerNetwork(network)
+		return
+	}
+	log.Printf("网络白名单: %s, 代理地址: %s", strings.Join(allowlist, ", "), proxy.Addr())
+	proxyURL := "http://" + proxy.Addr()
+	opts.Network = network
+	opts.Env = append(opts.Env,
+		"HTTP_PROXY="+proxyURL,
+		"HTTPS_PROXY="+proxyURL,
+		"http_proxy="+proxyURL,
+		"https_proxy="+proxyURL,
+		"NO_PROXY=localhost,127.0.0.1",
+		"no_proxy=localhost,127.0.0.1",
+	)
+	cleanup = func() {
+		_ = proxy.Close()
+		_ = removeDockerNetwork(network)
+	}
+	return
+}
+
+// removeDockerNetwork 删除 Docker 网络，即使构建已经被取消也需要执行
+func removeDockerNetwork(network string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cmds.CleanupTimeout)
+	defer cancel()
+	return cmds.DockerNetworkRemove(ctx, network)
+}
+
+func (r *Runner) deploy(ctx context.Context, u *Unit, workload UniversalWorkload) (err error) {
+	log.Printf("------------ 部署 [%s] ------------", workload.String())
+
+	// 加载集群预置文件
+	var preset Preset
+	if err = LoadPresetFromHome(workload.Cluster, &preset); err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("无法找到集群预置文件 %s, 请确认 --workload 参数是否正确", workload.Cluster)
+		}
+		return
+	}
+
+	// 生成 .docker/config.json 和 kubeconfig 文件
+	var dcDir, kcFile string
+	if dcDir, kcFile, err = preset.GenerateFiles(); err != nil {
+		return
+	}
+
+	// 环境配置的超时时间优先于集群预置文件
+	timeouts := u.Profile.Timeouts.Merge(preset.Timeouts, DefaultTimeouts)
+
+	// 临时性失败的重试策略
+	pushRetry := cmds.DefaultRetryPolicy.WithAttempts(preset.Retries.Push)
+	deployRetry := cmds.DefaultRetryPolicy.WithAttempts(preset.Retries.Deploy)
+
+	// 使用指定的远程镜像仓库地址
+	remoteImageNames := u.ImageNames.Derive(preset.Registry)
+
+	// 推送镜像到远程仓库
+	for _, remoteImageName := range remoteImageNames {
+		log.Printf("推送镜像: %s", remoteImageName)
+		if err = cmds.DockerTag(ctx, u.ImageNames.Primary(), remoteImageName); err != nil {
+			return
+		}
+		r.ImageTracker.Add(remoteImageName)
+		if err = r.push(ctx, timeouts.Push, func(ctx context.Context) error {
+			return cmds.DockerPush(ctx, pushRetry, remoteImageName, dcDir)
+		}); err != nil {
+			return
+		}
+	}
+
+	// 将构建产物附加到镜像上
+	if u.Profile.Artifacts.Attach && len(u.Report.Artifacts) > 0 {
+		var files []string
+		for _, a := range u.Report.Artifacts {
+			files = append(files, a.Path)
+		}
+		log.Printf("附加构建产物: %s", remoteImageNames.Primary())
+		if err = r.push(ctx, timeouts.Push, func(ctx context.Context) error {
+			return cmds.OrasAttach(ctx, remoteImageNames.Primary(), dcDir, ArtifactType, u.Report.ArtifactsDir, files)
+		}); err != nil {
+			return
+		}
+	}
+
+	// 推送镜像和执行 kubectl 命令分别使用 push 和 deploy 阶段的超时时间，deploy 阶段从推送完成后开始计时
+	deployCtx, cancel, err := withTimeout(ctx, "deploy", timeouts.Deploy)
+	if err != nil {
+		return
+	}
+	defer cancel()
+
+	// 打印 kubernetes 集群版本
+	_ = cmds.KubectlVersion(deployCtx, deployRetry, kcFile)
+
+	if r.SkipDeploy {
+		return
+	}
+
+	// 生成并应用 ConfigMap，挂载到容器中
+	profile := u.Profile
+	if profile.Volumes, err = r.applyConfigs(deployCtx, deployRetry, kcFile, u, workload); err != nil {
+		return
+	}
+
+	// 构建工作负载补丁
+	var patch UniversalPatch
+	if patch, err = CreateUniversalPatch(&preset, &profile, &workload, remoteImageNames.Primary()); err != nil {
+		return
+	}
+
+	// 查找以工作负载为目标的 HorizontalPodAutoscaler
+	autoscale := u.Profile.Autoscale != nil && workload.Scalable()
+	if patch.Spec.Replicas != nil || autoscale {
+		var hpa string
+		if hpa, err = r.findHPA(deployCtx, kcFile, workload); err != nil {
+			return
+		}
+		// 工作负载已经被 HorizontalPodAutoscaler 接管时，不再设置 replicas，避免和自动伸缩冲突
+		if patch.Spec.Replicas != nil && hpa != "" {
+			log.Printf("工作负载已经由 HorizontalPodAutoscaler %s 管理，忽略 replicas", hpa)
+			patch.Spec.Replicas = nil
+		}
+		// 只维护与工作负载同名，并且由 deployer2 创建的 HorizontalPodAutoscaler，在更新工作负载之前检查
+		if autoscale && hpa != "" {
+			if hpa != workload.Name {
+				err = fmt.Errorf("工作负载已经由 HorizontalPodAutoscaler %s 管理，拒绝创建新的 HorizontalPodAutoscaler %s", hpa, workload.Name)
+				return
+			}
+			if err = r.checkManaged(deployCtx, kcFile, workload.Namespace, "horizontalpodautoscalers/"+hpa); err != nil {
+				return
+			}
+		}
+	}
+	if (u.Profile.Replicas != nil || u.Profile.Autoscale != nil) && !workload.Scalable() {
+		log.Printf("警告: 工作负载类型 %s 不支持 replicas 和 autoscale，已忽略", workload.Type)
+	}
+
+	// 工作负载不存在时自动创建，之后照常执行 kubectl patch
+	if r.CreateMissing {
+		if err = r.createMissing(deployCtx, deployRetry, kcFile, &profile, workload, patch); err != nil {
+			return
+		}
+	}
+
+	// 执行 kubectl patch 命令，更新工作负载
+	var buf []byte
+	if buf, err = json.Marshal(patch); err != nil {
+		return
+	}
+	if err = cmds.KubectlPatch(deployCtx, deployRetry, kcFile, workload.Namespace, workload.Name, workload.Type, string(buf)); err != nil {
+		return
+	}
+
+	// 创建或者更新 HorizontalPodAutoscaler
+	if autoscale {
+		if err = r.applyHPA(deployCtx, deployRetry, kcFile, workload, *u.Profile.Autoscale); err != nil {
+			return
+		}
+	}
+
+	// 创建或者更新 Service 和 Ingress
+	if err = r.applyNetworking(deployCtx, deployRetry, kcFile, &profile, workload); err != nil {
+		return
+	}
+
+	// 使用 server-side apply 应用 manifests 字段中的资源
+	if err = r.applyManifests(deployCtx, deployRetry, kcFile, u, workload, remoteImageNames.Primary()); err != nil {
+		return
+	}
+
+	// 所有步骤成功后才记录本次部署的提交，避免部署失败时之后的构建被跳过
+	if r.Commit != "" {
+		if err = cmds.KubectlAnnotate(deployCtx, deployRetry, kcFile, workload.Namespace, workload.Name, workload.Type, AnnotationCommit+"="+r.Commit); err != nil {
+			return
+		}
+	}
+
+	// 删除旧版本的 ConfigMap
+	r.cleanConfigs(deployCtx, deployRetry, kcFile, u, workload, profile.Volumes)
+	return
+}
+
+// createMissing 工作负载不存在时，使用补丁生成完整的工作负载并创建，同时为健康检查端口创建同名的 Service
+func (r *Runner) createMissing(ctx context.Context, policy cmds.RetryPolicy, kcFile string, profile *Profile, workload UniversalWorkload, patch UniversalPatch) (err error) {
+	var exists bool
+	if exists, err = cmds.KubectlExists(ctx, kcFile, workload.Namespace, workload.Name, workload.Type); err != nil || exists {
+		return
+	}
+	var w Workload
+	if w, err = CreateWorkload(patch, &workload); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = json.Marshal(w); err != nil {
+		return
+	}
+	log.Printf("工作负载不存在，自动创建: %s", workload.String())
+	if err = cmds.KubectlCreate(ctx, policy, kcFile, workload.Namespace, buf); err != nil {
+		return
+	}
+
+	// 设置了 service 字段时，Service 在之后照常创建
+	if profile.Service != nil {
+		return
+	}
+	if exists, err = cmds.KubectlExists(ctx, kcFile, workload.Namespace, workload.Name, "service"); err != nil || exists {
+		return
+	}
+	svc := CreateBootstrapService(&workload, profile.Check.probe().Port)
+	if buf, err = json.Marshal(svc); err != nil {
+		return
+	}
+	log.Printf("自动创建 Service: %s, 端口 %d", svc.Metadata.Name, profile.Check.probe().Port)
+	err = cmds.KubectlCreate(ctx, policy, kcFile, workload.Namespace, buf)
+	return
+}
+
+// applyNetworking 创建或者更新 service 和 ingress 字段对应的 Service 和 Ingress
+func (r *Runner) applyNetworking(ctx context.Context, policy cmds.RetryPolicy, kcFile string, profile *Profile, workload UniversalWorkload) (err error) {
+	if profile.Service == nil && profile.Ingress == nil {
+		return
+	}
+	// 没有设置 service 字段时，Ingress 默认使用与工作负载同名的 Service 和健康检查端口
+	var us UniversalService
+	if profile.Service != nil {
+		us = *profile.Service
+	}
+	service := us.Generate(&workload, profile.Check.probe().Port)
+	if profile.Service != nil {
+		if err = r.applyManaged(ctx, policy, kcFile, workload.Namespace, "services/"+service.Metadata.Name, service); err != nil {
+			return
+		}
+	}
+	if profile.Ingress != nil {
+		var versions []string
+		if versions, err = cmds.KubectlAPIVersions(ctx, kcFile); err != nil {
+			return
+		}
+		var ingress Ingress
+		if ingress, err = profile.Ingress.Generate(SelectIngressAPIVersion(versions), &workload, service, profile.RenderString); err != nil {
+			return
+		}
+		if err = r.applyManaged(ctx, policy, kcFile, workload.Namespace, "ingresses/"+ingress.Metadata.Name, ingress); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// applyManifests 渲染 manifests 字段并使用 server-side apply 应用，渲染结果为空的模板会被跳过
+func (r *Runner) applyManifests(ctx context.Context, policy cmds.RetryPolicy, kcFile string, u *Unit, workload UniversalWorkload, imageName string) (err error) {
+	for i, m := range u.Profile.Manifests {
+		var buf []byte
+		if buf, err = m.Render(&u.Profile, u.Dir, &workload, imageName); err != nil {
+			return
+		}
+		if buf == nil {
+			log.Printf("跳过渲染结果为空的 %s", m.Name(i))
+			continue
+		}
+		log.Printf("应用 %s", m.Name(i))
+		if err = cmds.KubectlApplyServerSide(ctx, policy, kcFile, workload.Namespace, FieldManager, buf); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkManaged 检查资源是否可以由 deployer2 修改，资源不存在，或者由 deployer2 创建时返回 nil
+func (r *Runner) checkManaged(ctx context.Context, kcFile string, namespace string, resource string) (err error) {
+	var buf []byte
+	if buf, err = cmds.KubectlGetOptional(ctx, kcFile, namespace, resource); err != nil {
+		return
+	}
+	var exists, managed bool
+	if exists, managed, err = IsManaged(buf); err != nil {
+		return
+	}
+	if exists && !managed {
+		err = fmt.Errorf("%s 已经存在，但不是由 deployer2 创建的 (缺少标签 %s=%s)，拒绝修改", resource, LabelManagedBy, LabelManagedByValue)
+		return
+	}
+	return
+}
+
+// applyManaged 使用 kubectl apply 创建或者更新资源，已经存在但不是由 deployer2 创建的资源不会被修改
+func (r *Runner) applyManaged(ctx context.Context, policy cmds.RetryPolicy, kcFile string, namespace string, resource string, obj interface{}) (err error) {
+	if err = r.checkManaged(ctx, kcFile, namespace, resource); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = json.Marshal(obj); err != nil {
+		return
+	}
+	log.Printf("更新 %s", resource)
+	err = cmds.KubectlApply(ctx, policy, kcFile, namespace, buf)
+	return
+}
+
+// applyConfigs 使用 kubectl apply 创建 configs 字段生成的 ConfigMap，返回追加了对应卷的卷列表
+func (r *Runner) applyConfigs(ctx context.Context, policy cmds.RetryPolicy, kcFile string, u *Unit, workload UniversalWorkload) (volumes UniversalVolumes, err error) {
+	volumes = append(volumes, u.Profile.Volumes...)
+	for _, c := range u.Profile.Configs {
+		var cm ConfigMap
+		if cm, err = c.Generate(&u.Profile, u.Dir, &workload); err != nil {
+			return
+		}
+		var buf []byte
+		if buf, err = json.Marshal(cm); err != nil {
+			return
+		}
+		log.Printf("更新 ConfigMap: %s", cm.Metadata.Name)
+		if err = cmds.KubectlApply(ctx, policy, kcFile, workload.Namespace, buf); err != nil {
+			return
+		}
+		volumes = append(volumes, UniversalVolume{
+			Name:      c.VolumeName(),
+			ConfigMap: cm.Metadata.Name,
+			MountPath: c.MountPath,
+			ReadOnly:  true,
+		})
+	}
+	return
+}
+
+// cleanConfigs 删除超出保留数量的旧版本 ConfigMap，失败时只打印警告
+func (r *Runner) cleanConfigs(ctx context.Context, policy cmds.RetryPolicy, kcFile string, u *Unit, workload UniversalWorkload, volumes UniversalVolumes) {
+	current := map[string]string{}
+	for _, v := range volumes {
+		current[v.Name] = v.ConfigMap
+	}
+	for _, c := range u.Profile.Configs {
+		buf, err := cmds.KubectlListSelector(ctx, kcFile, workload.Namespace, "configmaps", c.Selector(&workload))
+		if err != nil {
+			log.Printf("警告: 无法列出配置 %s 的 ConfigMap: %s", c.Name, err.Error())
+			continue
+		}
+		var names []string
+		if names, err = c.Stale(buf, current[c.VolumeName()]); err != nil {
+			log.Printf("警告: 无法解析配置 %s 的 ConfigMap 列表: %s", c.Name, err.Error())
+			continue
+		}
+		if len(names) == 0 {
+			continue
+		}
+		log.Printf("删除旧版本 ConfigMap: %s", strings.Join(names, ", "))
+		if err = cmds.KubectlDelete(ctx, policy, kcFile, workload.Namespace, "configmaps", names...); err != nil {
+			log.Printf("警告: 无法删除旧版本 ConfigMap: %s", err.Error())
+		}
+	}
+}
+
+// findHPA 查找以工作负载为目标的 HorizontalPodAutoscaler，不存在时返回空字符串
+func (r *Runner) findHPA(ctx context.Context, kcFile string, workload UniversalWorkload) (name string, err error) {
+	var buf []byte
+	if buf, err = cmds.KubectlList(ctx, kcFile, workload.Namespace, "horizontalpodautoscalers"); err != nil {
+		return
+	}
+	name, err = FindHorizontalPodAutoscaler(buf, &workload)
+	return
+}
+
+// applyHPA 使用 kubectl apply 创建或者更新工作负载的 HorizontalPodAutoscaler
+func (r *Runner) applyHPA(ctx context.Context, policy cmds.RetryPolicy, kcFile string, workload UniversalWorkload, autoscale UniversalAutoscale) (err error) {
+	var versions []string
+	if versions, err = cmds.KubectlAPIVersions(ctx, kcFile); err != nil {
+		return
+	}
+	hpa := CreateHorizontalPodAutoscaler(SelectHPAAPIVersion(versions), &workload, autoscale)
+	log.Printf("HorizontalPodAutoscaler %s 副本数 %d - %d", hpa.Metadata.Name, autoscale.Min, autoscale.Max)
+	err = r.applyManaged(ctx, policy, kcFile, workload.Namespace, "horizontalpodautoscalers/"+hpa.Metadata.Name, hpa)
+	return
+}
+
+// push 使用独立的 push 阶段超时时间执行推送
+func (r *Runner) push(ctx context.Context, timeout string, fn func(ctx context.Context) error) error {
+	ctx, cancel, err := withTimeout(ctx, "push", timeout)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return fn(ctx)
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/acicn/deployer2/pkg/cmds"
+	"github.com/acicn/deployer2/pkg/image_tracker"
+	"github.com/acicn/deployer2/pkg/redact"
+	"github.com/guoyk93/tempfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testRunnerManifest = `
+version: 2
+default:
+  build:
+    - echo build
+  package:
+    - FROM nginx
+  workloads:
+    - test/default/deployment/hello
+`
+)
+
+// setupTestHome 使用临时目录作为 $HOME，并写入集群预置文件 test
+func setupTestHome(t *testing.T) (home string, restore func()) {
+	home, err := ioutil.TempDir("", "deployer2-runner-home")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".deployer2"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, ".deployer2", "preset-test.yml"), []byte(testPreset), 0644))
+	oldHome := os.Getenv("HOME")
+	require.NoError(t, os.Setenv("HOME", home))
+	restore = func() {
+		_ = os.Setenv("HOME", oldHome)
+		_ = os.RemoveAll(home)
+		tempfile.DeleteAll()
+		redact.Reset()
+	}
+	return
+}
+
+// normalizeLines 将工作目录替换为 <dir>，将临时文件替换为 <tmp>，便于断言命令序列
+func normalizeLines(lines []string, dir string) []string {
+	regexpTemp := regexp.MustCompile(regexp.QuoteMeta(os.TempDir()) + `/\S+`)
+	var out []string
+	for _, line := range lines {
+		line = strings.ReplaceAll(line, dir, "<dir>")
+		line = regexpTemp.ReplaceAllString(line, "<tmp>")
+		out = append(out, line)
+	}
+	return out
+}
+
+// testRun 一次 Runner.Run 记录的命令
+type testRun struct {
+	// Lines 经过 normalizeLines 处理的命令行
+	Lines    []string
+	Commands []cmds.RecordedCommand
+}
+
+// runTestUnit 使用 manifest 中的 profile 环境执行一次 Runner.Run，只返回本次执行记录的命令
+func runTestUnit(t *testing.T, r *cmds.Recorder, runner *Runner, home string, manifest string, profile string) (run testRun, err error) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(manifest), &m))
+	p, err := m.Profile(profile)
+	require.NoError(t, err)
+	u := &Unit{
+		Dir:        home,
+		Profile:    p,
+		ImageNames: NewImageNames("hello", profile, "1"),
+		Workloads:  p.Workloads,
+	}
+	start := len(r.Commands())
+	err = runner.Run(context.Background(), u)
+	run.Commands = r.Commands()[start:]
+	var lines []string
+	for _, c := range run.Commands {
+		lines = append(lines, c.String())
+	}
+	run.Lines = normalizeLines(lines, home)
+	return
+}
+
+// Match 返回命令行以 prefix 开头的命令，prefix 使用 normalizeLines 处理后的格式
+func (run testRun) Match(prefix string) (out []cmds.RecordedCommand) {
+	for i, line := range run.Lines {
+		if strings.HasPrefix(line, prefix) {
+			out = append(out, run.Commands[i])
+		}
+	}
+	return
+}
+
+// assertSequence 断言 lines 中按照顺序出现以 prefixes 中每一项开头的命令，允许中间穿插其他命令
+func assertSequence(t *testing.T, prefixes []string, lines []string) bool {
+	i := 0
+	for _, line := range lines {
+		if i < len(prefixes) && strings.HasPrefix(line, prefixes[i]) {
+			i++
+		}
+	}
+	if i < len(prefixes) {
+		return assert.Fail(t, "命令序列不匹配", "缺少 %q\n实际命令:\n%s", prefixes[i], strings.Join(lines, "\n"))
+	}
+	return true
+}
+
+const (
+	testKubectl      = "kubectl --kubeconfig <tmp> "
+	testKubectlNS    = testKubectl + "--namespace default "
+	testKubectlPatch = testKubectlNS + "patch deployments/hello -p "
+	testKubectlApply = testKubectlNS + "apply -f -"
+)
+
+func TestRunner_Run(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	r := &cmds.Recorder{}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(testRunnerManifest), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+
+	u := &Unit{
+		Dir:        home,
+		Profile:    p,
+		ImageNames: NewImageNames("hello", "test", "1"),
+		Workloads:  p.Workloads,
+	}
+	runner := &Runner{ImageTracker: image_tracker.New(), Commit: "abcdef"}
+	require.NoError(t, runner.Run(context.Background(), u))
+
+	lines := normalizeLines(r.Lines(), home)
+	require.Len(t, lines, 9)
+	assert.Equal(t, []string{
+		"bash <tmp>",
+		"docker build -t hello:test-build-1 -f <tmp> <dir>",
+		"docker tag hello:test-build-1 registry.example.com/hello/hello:test-build-1",
+		"docker --config <tmp> push registry.example.com/hello/hello:test-build-1",
+		"docker tag hello:test-build-1 registry.example.com/hello/hello:test",
+		"docker --config <tmp> push registry.example.com/hello/hello:test",
+		"kubectl --kubeconfig <tmp> version",
+	}, lines[:7])
+	assert.True(t, strings.HasPrefix(lines[7], "kubectl --kubeconfig <tmp> --namespace default patch deployments/hello -p "))
+	assert.NotContains(t, lines[7], "net.guoyk.deployer/commit")
+	assert.Equal(t, "kubectl --kubeconfig <tmp> --namespace default annotate --overwrite deployments/hello net.guoyk.deployer/commit=abcdef", lines[8])
+	assert.Equal(t, home, r.Commands()[0].Dir)
+	assert.Len(t, u.Report.Steps, 1)
+}
+
+func TestRunner_Run_CommitAfterDeploy(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	// 更新工作负载之后的步骤失败时，不记录本次部署的提交
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		if strings.HasSuffix(c.String(), " apply -f -") {
+			return "", &cmds.ExitError{Code: 1}
+		}
+		return "", nil
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	runner := &Runner{ImageTracker: image_tracker.New(), Commit: "abcdef"}
+	run, err := runTestUnit(t, r, runner, home, testRunnerManifest+`
+test:
+  service: {}
+`, "test")
+	require.Error(t, err)
+	assert.Len(t, run.Match(testKubectlPatch), 1)
+	assert.Empty(t, run.Match(testKubectlNS+"annotate "))
+}
+
+func TestRunner_Run_SlowPush(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	// 推送耗时超过 deploy 阶段的超时时间，不应影响之后的 kubectl 命令
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		if strings.Contains(c.String(), " push ") {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return "", nil
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	run, err := runTestUnit(t, r, &Runner{ImageTracker: image_tracker.New()}, home, testRunnerManifest+`
+test:
+  timeouts:
+    deploy: 200ms
+`, "test")
+	require.NoError(t, err)
+	assertSequence(t, []string{testKubectl + "version", testKubectlPatch}, run.Lines)
+}
+
+func TestRunner_Run_BuilderUser(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	r := &cmds.Recorder{}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	manifest := `
+version: 2
+default:
+  builder:
+    image: acicn/node-builder:12
+    caches:
+      - /cache/npm
+  build:
+    - npm install
+  package:
+    - FROM nginx
+root:
+  builder:
+    isolation:
+      root: true
+user:
+  builder:
+    user: "1000:1000"
+home:
+  builder:
+    env:
+      HOME: /workspace
+`
+	// 返回构建容器的 docker run 命令行和引导脚本
+	dockerRun := func(profile string) (string, string) {
+		run, err := runTestUnit(t, r, &Runner{ImageTracker: image_tracker.New(), SkipDeploy: true}, home, manifest, profile)
+		require.NoError(t, err)
+		commands := run.Match("docker run ")
+		require.Len(t, commands, 1)
+		return commands[0].String(), commands[0].Stdin
+	}
+
+	// 默认以宿主机用户身份执行，并设置可写的 $HOME
+	line, _ := dockerRun("test")
+	assert.Contains(t, line, fmt.Sprintf(" --user %d:%d ", os.Getuid(), os.Getgid()))
+	assert.Contains(t, line, " -e HOME=/tmp ")
+
+	// root: true 恢复旧的行为
+	line, script := dockerRun("root")
+	assert.NotContains(t, line, " --user ")
+	assert.NotContains(t, line, "HOME=")
+	assert.Contains(t, script, "chown -R")
+
+	// 明确指定的用户不修改 $HOME
+	line, _ = dockerRun("user")
+	assert.Contains(t, line, " --user 1000:1000 ")
+	assert.NotContains(t, line, "HOME=")
+
+	// 构建脚本以只读方式挂载，其他用户需要能够读取，所在目录仅允许当前用户访问
+	var file string
+	for _, arg := range strings.Fields(line) {
+		if strings.HasSuffix(arg, ":"+cmds.InDockerScript+":ro") {
+			file = strings.TrimSuffix(arg, ":"+cmds.InDockerScript+":ro")
+		}
+	}
+	require.NotEmpty(t, file)
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(file))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// env 中设置的 HOME 优先
+	line, _ = dockerRun("home")
+	assert.Contains(t, line, " -e HOME=/workspace ")
+	assert.NotContains(t, line, "HOME=/tmp")
+}
+
+func TestRunner_Changed(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		switch {
+		case strings.Contains(c.String(), " get deployments/hello "):
+			return `{"metadata":{"annotations":{"net.guoyk.deployer/commit":"123456"}}}`, nil
+		case c.String() == "git diff --name-only --relative 123456 abcdef":
+			return "docs/README.md\n", nil
+		}
+		return "", &cmds.ExitError{Code: 1}
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(testRunnerManifest), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	p.Paths = []string{"src/**"}
+
+	u := &Unit{Dir: home, Profile: p, Workloads: p.Workloads}
+	runner := &Runner{RepoDir: home, Commit: "abcdef"}
+	changed, err := runner.Changed(context.Background(), u)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	u.Profile.Paths = []string{"docs/**"}
+	changed, err = runner.Changed(context.Background(), u)
+	require.NoError(t, err)
+	assert.True(t, changed)
+}
+
+func TestRunner_Run_Autoscale(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	hpaList := `{"items":[{"metadata":{"name":"hello"},"spec":{"scaleTargetRef":{"kind":"Deployment","name":"hello"}}}]}`
+	hpa := ""
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		switch {
+		case strings.HasSuffix(c.String(), " get horizontalpodautoscalers -o json"):
+			return hpaList, nil
+		case strings.HasSuffix(c.String(), " get horizontalpodautoscalers/hello --ignore-not-found -o json"):
+			return hpa, nil
+		case strings.HasSuffix(c.String(), " api-versions"):
+			return "apps/v1\nautoscaling/v2\n", nil
+		}
+		return "", nil
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	manifest := testRunnerManifest + `
+test:
+  replicas: 3
+prod:
+  autoscale:
+    max: 4
+`
+	runner := &Runner{ImageTracker: image_tracker.New()}
+
+	// 已经存在 HorizontalPodAutoscaler 时不设置 replicas
+	run, err := runTestUnit(t, r, runner, home, manifest, "test")
+	require.NoError(t, err)
+	assertSequence(t, []string{testKubectlNS + "get horizontalpodautoscalers -o json", testKubectlPatch}, run.Lines)
+	patches := run.Match(testKubectlPatch)
+	require.Len(t, patches, 1)
+	assert.NotContains(t, patches[0].String(), `"replicas"`)
+
+	// 设置了 autoscale 时，更新工作负载后 apply HorizontalPodAutoscaler
+	hpaList = `{"items":[]}`
+	run, err = runTestUnit(t, r, runner, home, manifest, "prod")
+	require.NoError(t, err)
+	assertSequence(t, []string{
+		testKubectlPatch,
+		testKubectl + "api-versions",
+		testKubectlNS + "get horizontalpodautoscalers/hello --ignore-not-found -o json",
+		testKubectlApply,
+	}, run.Lines)
+	applies := run.Match(testKubectlApply)
+	require.Len(t, applies, 1)
+	assert.Contains(t, applies[0].Stdin, `"apiVersion":"autoscaling/v2"`)
+	assert.Contains(t, applies[0].Stdin, `"maxReplicas":4`)
+
+	// 已经由 deployer2 创建的同名 HorizontalPodAutoscaler 可以更新
+	hpaList = `{"items":[{"metadata":{"name":"hello"},"spec":{"scaleTargetRef":{"kind":"Deployment","name":"hello"}}}]}`
+	hpa = `{"metadata":{"name":"hello","labels":{"app.kubernetes.io/managed-by":"deployer2"}}}`
+	run, err = runTestUnit(t, r, runner, home, manifest, "prod")
+	require.NoError(t, err)
+	assertSequence(t, []string{testKubectlPatch, testKubectlApply}, run.Lines)
+
+	// 工作负载已经由其他名称的 HorizontalPodAutoscaler 管理时，拒绝部署，不修改工作负载
+	hpaList = `{"items":[{"metadata":{"name":"hello-hpa"},"spec":{"scaleTargetRef":{"kind":"Deployment","name":"hello"}}}]}`
+	run, err = runTestUnit(t, r, runner, home, manifest, "prod")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hello-hpa")
+	assert.Empty(t, run.Match(testKubectlPatch))
+
+	// 同名的 HorizontalPodAutoscaler 不是由 deployer2 创建的，拒绝部署，不修改工作负载
+	hpaList = `{"items":[{"metadata":{"name":"hello"},"spec":{"scaleTargetRef":{"kind":"Deployment","name":"hello"}}}]}`
+	hpa = `{"metadata":{"name":"hello","labels":{}}}`
+	run, err = runTestUnit(t, r, runner, home, manifest, "prod")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "app.kubernetes.io/managed-by")
+	assert.Empty(t, run.Match(testKubectlPatch))
+	assert.Empty(t, run.Match(testKubectlApply))
+}
+
+func TestRunner_Run_Configs(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "app.yaml"), []byte("env: {{.Profile}}\n"), 0644))
+
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		if strings.Contains(c.String(), " get configmaps -l ") {
+			return `{"items":[
+  {"metadata":{"name":"hello-app-old2","creationTimestamp":"2020-01-02T00:00:00Z"}},
+  {"metadata":{"name":"hello-app-old1","creationTimestamp":"2020-01-01T00:00:00Z"}}
+]}`, nil
+		}
+		return "", nil
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	run, err := runTestUnit(t, r, &Runner{ImageTracker: image_tracker.New()}, home, testRunnerManifest+`
+test:
+  configs:
+    - name: app
+      files: [app.yaml]
+      mountPath: /app/config
+      history: 2
+`, "test")
+	require.NoError(t, err)
+
+	// 先创建 ConfigMap，再更新工作负载，最后清理超出保留数量的旧版本
+	assertSequence(t, []string{
+		testKubectlApply,
+		testKubectlPatch,
+		testKubectlNS + "get configmaps -l app.kubernetes.io/managed-by=deployer2,net.guoyk.deployer/workload=hello,net.guoyk.deployer/config=app -o json",
+		testKubectlNS + "delete configmaps --ignore-not-found hello-app-old1",
+	}, run.Lines)
+	applies := run.Match(testKubectlApply)
+	require.Len(t, applies, 1)
+	assert.Contains(t, applies[0].Stdin, `"env: test\n"`)
+	patches := run.Match(testKubectlPatch)
+	require.Len(t, patches, 1)
+	assert.Contains(t, patches[0].String(), `"name":"config-app"`)
+	assert.Len(t, run.Match(testKubectlNS+"delete "), 1)
+}
+
+func TestRunner_Run_CreateMissing(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		// 工作负载和 Service 都不存在
+		return "", nil
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	runner := &Runner{ImageTracker: image_tracker.New(), CreateMissing: true}
+	run, err := runTestUnit(t, r, runner, home, testRunnerManifest, "test")
+	require.NoError(t, err)
+	assertSequence(t, []string{
+		testKubectlNS + "get deployments/hello --ignore-not-found -o name",
+		testKubectlNS + "create -f -",
+		testKubectlNS + "get services/hello --ignore-not-found -o name",
+		testKubectlNS + "create -f -",
+		testKubectlPatch,
+	}, run.Lines)
+	creates := run.Match(testKubectlNS + "create -f -")
+	require.Len(t, creates, 2)
+	assert.Contains(t, creates[0].Stdin, `"kind":"Deployment"`)
+	assert.Contains(t, creates[1].Stdin, `"kind":"Service"`)
+
+	// 工作负载已经存在时只执行 kubectl patch
+	r.Handler = func(c cmds.Command) (string, error) {
+		if strings.HasSuffix(c.String(), " --ignore-not-found -o name") {
+			return "deployment.apps/hello\n", nil
+		}
+		return "", nil
+	}
+	run, err = runTestUnit(t, r, runner, home, testRunnerManifest, "test")
+	require.NoError(t, err)
+	assertSequence(t, []string{
+		testKubectlNS + "get deployments/hello --ignore-not-found -o name",
+		testKubectlPatch,
+	}, run.Lines)
+	assert.Empty(t, run.Match(testKubectlNS+"create "))
+}
+
+func TestRunner_Run_Service(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+
+	ingress := ""
+	r := &cmds.Recorder{Handler: func(c cmds.Command) (string, error) {
+		switch {
+		case strings.HasSuffix(c.String(), " api-versions"):
+			return "networking.k8s.io/v1\n", nil
+		case strings.Contains(c.String(), " get services/hello "):
+			return `{"metadata":{"labels":{"app.kubernetes.io/managed-by":"deployer2"}}}`, nil
+		case strings.Contains(c.String(), " get ingresses/hello "):
+			return ingress, nil
+		}
+		return "", nil
+	}}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	manifest := testRunnerManifest + `
+test:
+  service: {}
+  ingress:
+    hosts: [hello.example.com]
+`
+	runner := &Runner{ImageTracker: image_tracker.New()}
+	run, err := runTestUnit(t, r, runner, home, manifest, "test")
+	require.NoError(t, err)
+	assertSequence(t, []string{
+		testKubectlPatch,
+		testKubectlNS + "get services/hello --ignore-not-found -o json",
+		testKubectlApply,
+		testKubectl + "api-versions",
+		testKubectlNS + "get ingresses/hello --ignore-not-found -o json",
+		testKubectlApply,
+	}, run.Lines)
+	applies := run.Match(testKubectlApply)
+	require.Len(t, applies, 2)
+	assert.Contains(t, applies[0].Stdin, `"kind":"Service"`)
+	assert.Contains(t, applies[1].Stdin, `"host":"hello.example.com"`)
+
+	// 不是由 deployer2 创建的 Ingress 不会被修改
+	ingress = `{"metadata":{"labels":{"app":"hello"}}}`
+	run, err = runTestUnit(t, r, runner, home, manifest, "test")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ingresses/hello")
+	applies = run.Match(testKubectlApply)
+	require.Len(t, applies, 1)
+	assert.Contains(t, applies[0].Stdin, `"kind":"Service"`)
+}
+
+func TestRunner_Run_Manifests(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "k8s"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "k8s", "test.yaml"), []byte("kind: ServiceMonitor\n"), 0644))
+
+	r := &cmds.Recorder{}
+	defer cmds.SetExecutor(cmds.SetExecutor(r))
+
+	run, err := runTestUnit(t, r, &Runner{ImageTracker: image_tracker.New()}, home, testManifestsManifest, "test")
+	require.NoError(t, err)
+
+	// 更新工作负载之后应用 manifests，渲染结果为空的模板被跳过
+	apply := testKubectlNS + "apply --server-side --field-manager deployer2 -f -"
+	assertSequence(t, []string{testKubectlPatch, apply, apply}, run.Lines)
+	applies := run.Match(apply)
+	require.Len(t, applies, 2)
+	assert.Contains(t, applies[0].Stdin, "kind: PodDisruptionBudget")
+	assert.Equal(t, "kind: ServiceMonitor\n", applies[1].Stdin)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var (
+	// DefaultTimeouts 各阶段的默认超时时间，避免卡住的 docker push 或者无法访问的 kubectl 一直占用 Jenkins 执行器
+	DefaultTimeouts = Timeouts{
+		Push:   "30m",
+		Deploy: "10m",
+	}
+)
+
+// Timeouts 各阶段的超时时间，格式同 Go 的 time.ParseDuration，比如 30m，0 表示不限制
+type Timeouts struct {
+	// Build 每个构建步骤的超时时间
+	Build string `yaml:"build"`
+	// Package 打包，即 docker build 的超时时间
+	Package string `yaml:"package"`
+	// Push 推送每个镜像的超时时间
+	Push string `yaml:"push"`
+	// Deploy 每个工作负载执行 kubectl 命令的超时时间
+	Deploy string `yaml:"deploy"`
+}
+
+// Merge 使用 others 依次填充未设置的字段
+func (t Timeouts) Merge(others ...Timeouts) Timeouts {
+	for _, o := range others {
+		if t.Build == "" {
+			t.Build = o.Build
+		}
+		if t.Package == "" {
+			t.Package = o.Package
+		}
+		if t.Push == "" {
+			t.Push = o.Push
+		}
+		if t.Deploy == "" {
+			t.Deploy = o.Deploy
+		}
+	}
+	return t
+}
+
+// withTimeout 创建带有超时时间的 ctx，value 为空或者为 0 时不限制
+func withTimeout(ctx context.Context, stage string, value string) (context.Context, context.CancelFunc, error) {
+	if value == "" {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("无法解析 %s 阶段的超时时间 %s: %s", stage, value, err.Error())
+	}
+	if d <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, cancel, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTimeouts_Merge(t *testing.T) {
+	profile := Timeouts{Build: "1h", Push: "5m"}
+	preset := Timeouts{Push: "10m", Deploy: "2m"}
+	assert.Equal(t, Timeouts{Build: "1h", Push: "5m", Deploy: "2m"}, profile.Merge(preset, DefaultTimeouts))
+	assert.Equal(t, Timeouts{Push: "30m", Deploy: "10m"}, Timeouts{}.Merge(DefaultTimeouts))
+}
+
+func TestWithTimeout(t *testing.T) {
+	ctx, cancel, err := withTimeout(context.Background(), "build", "")
+	require.NoError(t, err)
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+
+	ctx, cancel, err = withTimeout(context.Background(), "build", "0")
+	require.NoError(t, err)
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+
+	ctx, cancel, err = withTimeout(context.Background(), "push", "5m")
+	require.NoError(t, err)
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.True(t, time.Until(deadline) > time.Minute*4)
+	cancel()
+
+	_, _, err = withTimeout(context.Background(), "push", "5 minutes")
+	assert.Error(t, err)
+}
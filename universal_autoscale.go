@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	// HPAAPIVersion 优先使用的 HorizontalPodAutoscaler API 版本，集群不支持时使用 HPAAPIVersionBeta
+	HPAAPIVersion     = "autoscaling/v2"
+	HPAAPIVersionBeta = "autoscaling/v2beta2"
+
+	// LabelManagedBy 由 deployer2 创建的资源的标签
+	LabelManagedBy      = "app.kubernetes.io/managed-by"
+	LabelManagedByValue = "deployer2"
+
+	defaultAutoscaleCPU = 80
+)
+
+// UniversalAutoscale 自动伸缩配置，设置后 deployer2 创建或者更新同名的 HorizontalPodAutoscaler，不再管理 replicas
+type UniversalAutoscale struct {
+	// Min 最少副本数，默认为 1
+	Min int `yaml:"min"`
+	// Max 最多副本数
+	Max int `yaml:"max"`
+	// CPU 目标 CPU 平均使用率，百分比，CPU 和 Memory 都没有设置时默认为 80
+	CPU int `yaml:"cpu"`
+	// Memory 目标内存平均使用率，百分比
+	Memory int `yaml:"memory"`
+}
+
+func (a *UniversalAutoscale) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	type plain UniversalAutoscale
+	if err = unmarshal((*plain)(a)); err != nil {
+		return
+	}
+	if a.Min == 0 {
+		a.Min = 1
+	}
+	if a.Max < a.Min {
+		err = errors.New("autoscale.max 必须设置，且不小于 autoscale.min")
+		return
+	}
+	if a.CPU < 0 || a.Memory < 0 {
+		err = errors.New("autoscale.cpu 和 autoscale.memory 不能为负数")
+		return
+	}
+	if a.CPU == 0 && a.Memory == 0 {
+		a.CPU = defaultAutoscaleCPU
+	}
+	return
+}
+
+type hpaMetricTarget struct {
+	Type               string `json:"type"`
+	AverageUtilization int32  `json:"averageUtilization"`
+}
+
+type hpaMetric struct {
+	Type     string `json:"type"`
+	Resource struct {
+		Name   string          `json:"name"`
+		Target hpaMetricTarget `json:"target"`
+	} `json:"resource"`
+}
+
+// HorizontalPodAutoscaler autoscaling/v2 和 autoscaling/v2beta2 通用的 HorizontalPodAutoscaler，只包含 deployer2 管理的字段
+type HorizontalPodAutoscaler struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		ScaleTargetRef struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Name       string `json:"name"`
+		} `json:"scaleTargetRef"`
+		MinReplicas int32       `json:"minReplicas"`
+		MaxReplicas int32       `json:"maxReplicas"`
+		Metrics     []hpaMetric `json:"metrics"`
+	} `json:"spec"`
+}
+
+func newHPAMetric(name string, utilization int) hpaMetric {
+	var m hpaMetric
+	m.Type = "Resource"
+	m.Resource.Name = name
+	m.Resource.Target = hpaMetricTarget{Type: "Utilization", AverageUtilization: int32(utilization)}
+	return m
+}
+
+// CreateHorizontalPodAutoscaler 为工作负载生成同名的 HorizontalPodAutoscaler
+func CreateHorizontalPodAutoscaler(apiVersion string, workload *UniversalWorkload, a UniversalAutoscale) (h HorizontalPodAutoscaler) {
+	h.APIVersion = apiVersion
+	h.Kind = "HorizontalPodAutoscaler"
+	h.Metadata.Name = workload.Name
+	h.Metadata.Namespace = workload.Namespace
+	h.Metadata.Labels = map[string]string{LabelManagedBy: LabelManagedByValue}
+	h.Spec.ScaleTargetRef.APIVersion = "apps/v1"
+	h.Spec.ScaleTargetRef.Kind = workload.Kind()
+	h.Spec.ScaleTargetRef.Name = workload.Name
+	h.Spec.MinReplicas = int32(a.Min)
+	h.Spec.MaxReplicas = int32(a.Max)
+	if a.CPU > 0 {
+		h.Spec.Metrics = append(h.Spec.Metrics, newHPAMetric("cpu", a.CPU))
+	}
+	if a.Memory > 0 {
+		h.Spec.Metrics = append(h.Spec.Metrics, newHPAMetric("memory", a.Memory))
+	}
+	return
+}
+
+// SelectHPAAPIVersion 根据集群支持的 API 版本选择 HorizontalPodAutoscaler 的 API 版本
+func SelectHPAAPIVersion(versions []string) string {
+	for _, v := range versions {
+		if v == HPAAPIVersion {
+			return HPAAPIVersion
+		}
+	}
+	return HPAAPIVersionBeta
+}
+
+// FindHorizontalPodAutoscaler 在 kubectl get hpa -o json 的输出中查找以工作负载为目标的 HorizontalPodAutoscaler，返回其名称
+func FindHorizontalPodAutoscaler(buf []byte, workload *UniversalWorkload) (name string, err error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Spec struct {
+				ScaleTargetRef struct {
+					Kind string `json:"kind"`
+					Name string `json:"name"`
+				} `json:"scaleTargetRef"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(buf, &list); err != nil {
+		return
+	}
+	for _, item := range list.Items {
+		ref := item.Spec.ScaleTargetRef
+		if ref.Kind == workload.Kind() && ref.Name == workload.Name {
+			name = item.Metadata.Name
+			return
+		}
+	}
+	return
+}
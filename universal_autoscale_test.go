@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestUniversalAutoscale_UnmarshalYAML(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  autoscale:
+    max: 5
+`), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	require.NotNil(t, p.Autoscale)
+	assert.Equal(t, UniversalAutoscale{Min: 1, Max: 5, CPU: 80}, *p.Autoscale)
+
+	err = LoadManifest([]byte(`
+version: 2
+default:
+  autoscale:
+    min: 3
+    max: 2
+`), &m)
+	assert.Error(t, err)
+}
+
+func TestCreateUniversalPatch_Replicas(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  replicas: 3
+prod:
+  autoscale:
+    min: 2
+    max: 10
+`), &m))
+
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	require.NotNil(t, patch.Spec.Replicas)
+	assert.Equal(t, int32(3), *patch.Spec.Replicas)
+
+	// 设置了自动伸缩时不再管理 replicas
+	p, err = m.Profile("prod")
+	require.NoError(t, err)
+	patch, err = CreateUniversalPatch(&Preset{}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	assert.Nil(t, patch.Spec.Replicas)
+
+	// DaemonSet 没有 replicas 字段
+	require.NoError(t, w.Set("test/default/daemonset/hello"))
+	p, err = m.Profile("test")
+	require.NoError(t, err)
+	patch, err = CreateUniversalPatch(&Preset{}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	assert.Nil(t, patch.Spec.Replicas)
+}
+
+func TestCreateHorizontalPodAutoscaler(t *testing.T) {
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/sts/hello"))
+	hpa := CreateHorizontalPodAutoscaler(SelectHPAAPIVersion([]string{"v1", "autoscaling/v2beta2"}), &w, UniversalAutoscale{Min: 2, Max: 6, CPU: 70, Memory: 90})
+	buf, err := json.Marshal(hpa)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+  "apiVersion": "autoscaling/v2beta2",
+  "kind": "HorizontalPodAutoscaler",
+  "metadata": {"name": "hello", "namespace": "default", "labels": {"app.kubernetes.io/managed-by": "deployer2"}},
+  "spec": {
+    "scaleTargetRef": {"apiVersion": "apps/v1", "kind": "StatefulSet", "name": "hello"},
+    "minReplicas": 2,
+    "maxReplicas": 6,
+    "metrics": [
+      {"type": "Resource", "resource": {"name": "cpu", "target": {"type": "Utilization", "averageUtilization": 70}}},
+      {"type": "Resource", "resource": {"name": "memory", "target": {"type": "Utilization", "averageUtilization": 90}}}
+    ]
+  }
+}`, string(buf))
+	assert.Equal(t, HPAAPIVersion, SelectHPAAPIVersion([]string{"autoscaling/v2", "autoscaling/v2beta2"}))
+
+	name, err := FindHorizontalPodAutoscaler([]byte(`{"items":[
+  {"metadata":{"name":"other"},"spec":{"scaleTargetRef":{"kind":"Deployment","name":"hello"}}},
+  {"metadata":{"name":"hello-hpa"},"spec":{"scaleTargetRef":{"kind":"StatefulSet","name":"hello"}}}
+]}`), &w)
+	require.NoError(t, err)
+	assert.Equal(t, "hello-hpa", name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Workload --create-missing 模式下创建的工作负载，只包含必要的字段，其余字段由之后的补丁维护
+type Workload struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas *int32 `json:"replicas,omitempty"`
+		// ServiceName StatefulSet 必须设置，使用同名的 Service
+		ServiceName string `json:"serviceName,omitempty"`
+		Selector    struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+		Template struct {
+			Metadata struct {
+				Labels      map[string]string `json:"labels,omitempty"`
+				Annotations map[string]string `json:"annotations,omitempty"`
+			} `json:"metadata"`
+			Spec corev1.PodSpec `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+// CreateWorkload 使用补丁生成完整的工作负载，Pod 使用 net.guoyk.deployer/workload 标签选择
+func CreateWorkload(patch UniversalPatch, workload *UniversalWorkload) (w Workload, err error) {
+	switch workload.Kind() {
+	case "Deployment", "StatefulSet", "DaemonSet":
+	default:
+		err = fmt.Errorf("不支持自动创建 %s 类型的工作负载", workload.Type)
+		return
+	}
+	if workload.Labels.Init {
+		err = fmt.Errorf("不支持自动创建只包含 init 容器的工作负载: %s", workload.String())
+		return
+	}
+	w.APIVersion = "apps/v1"
+	w.Kind = workload.Kind()
+	w.Metadata.Name = workload.Name
+	w.Metadata.Namespace = workload.Namespace
+	w.Metadata.Labels = map[string]string{
+		LabelManagedBy: LabelManagedByValue,
+		LabelWorkload:  workload.Name,
+	}
+	w.Metadata.Annotations = patch.Metadata.Annotations
+	if workload.Scalable() {
+		w.Spec.Replicas = patch.Spec.Replicas
+	}
+	if w.Kind == "StatefulSet" {
+		w.Spec.ServiceName = workload.Name
+	}
+	w.Spec.Selector.MatchLabels = map[string]string{LabelWorkload: workload.Name}
+	w.Spec.Template.Metadata.Labels = map[string]string{}
+	for k, v := range patch.Spec.Template.Metadata.Labels {
+		w.Spec.Template.Metadata.Labels[k] = v
+	}
+	w.Spec.Template.Metadata.Labels[LabelWorkload] = workload.Name
+	w.Spec.Template.Metadata.Annotations = patch.Spec.Template.Metadata.Annotations
+	w.Spec.Template.Spec = patch.Spec.Template.Spec
+	return
+}
+
+// CreateBootstrapService 为工作负载的健康检查端口生成同名的 Service
+func CreateBootstrapService(workload *UniversalWorkload, port int) Service {
+	return UniversalService{}.Generate(workload, port)
+}
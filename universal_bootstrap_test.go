@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCreateWorkload(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  replicas: 2
+  check:
+    port: 3000
+    path: /health
+`), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/statefulset/hello"))
+
+	patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	workload, err := CreateWorkload(patch, &w)
+	require.NoError(t, err)
+	assert.Equal(t, "apps/v1", workload.APIVersion)
+	assert.Equal(t, "StatefulSet", workload.Kind)
+	assert.Equal(t, "hello", workload.Spec.ServiceName)
+	assert.Equal(t, int32(2), *workload.Spec.Replicas)
+	assert.Equal(t, map[string]string{LabelWorkload: "hello"}, workload.Spec.Selector.MatchLabels)
+	assert.Equal(t, "hello", workload.Spec.Template.Metadata.Labels[LabelWorkload])
+	require.Len(t, workload.Spec.Template.Spec.Containers, 1)
+	container := workload.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, "hello", container.Name)
+	assert.Equal(t, "hello:test", container.Image)
+	assert.NotNil(t, container.ReadinessProbe)
+
+	svc := CreateBootstrapService(&w, p.Check.probe().Port)
+	buf, err := json.Marshal(svc)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+  "apiVersion": "v1",
+  "kind": "Service",
+  "metadata": {"name": "hello", "namespace": "default", "labels": {"app.kubernetes.io/managed-by": "deployer2", "net.guoyk.deployer/workload": "hello"}},
+  "spec": {
+    "selector": {"net.guoyk.deployer/workload": "hello"},
+    "ports": [{"name": "http", "protocol": "TCP", "port": 3000, "targetPort": 3000}]
+  }
+}`, string(buf))
+
+	require.NoError(t, w.Set("test/default/cronjob/hello"))
+	_, err = CreateWorkload(patch, &w)
+	assert.Error(t, err)
+}
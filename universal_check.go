@@ -1,13 +1,27 @@
 package main
 
 import (
+	"fmt"
 	"github.com/imdario/mergo"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"sort"
+	"strconv"
+)
+
+const (
+	CheckTypeHTTP  CheckType = "http"
+	CheckTypeHTTPS CheckType = "https"
+	CheckTypeTCP   CheckType = "tcp"
+	CheckTypeExec  CheckType = "exec"
+	CheckTypeGRPC  CheckType = "grpc"
+
+	// GRPCHealthProbeCommand gRPC 健康检查命令，当前使用的 Kubernetes API 不支持原生 gRPC 探针，需要镜像中包含 grpc_health_probe
+	GRPCHealthProbeCommand = "grpc_health_probe"
 )
 
 var (
-	defaultUniversalCheck = UniversalCheck{
+	defaultUniversalCheck = UniversalProbe{
 		Port:     8080,
 		Delay:    60,
 		Interval: 15,
@@ -15,11 +29,44 @@ var (
 		Failure:  2,
 		Timeout:  5,
 	}
+
+	// defaultStartupProbe 启动探针的默认值，最多等待 10 * 30 = 300 秒，探测成功后才开始存活和就绪探测
+	defaultStartupProbe = UniversalProbe{
+		Interval: 10,
+		Success:  1,
+		Failure:  30,
+	}
 )
 
-type UniversalCheck struct {
-	Port     int    `yaml:"port"`
-	Path     string `yaml:"path"`
+// CheckType 探测方式，可以为 http (默认), https, tcp, exec, grpc
+type CheckType string
+
+func (t *CheckType) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return
+	}
+	switch v := CheckType(s); v {
+	case "", CheckTypeHTTP, CheckTypeHTTPS, CheckTypeTCP, CheckTypeExec, CheckTypeGRPC:
+		*t = v
+	default:
+		err = fmt.Errorf("不支持的健康检查方式: %s", s)
+	}
+	return
+}
+
+// UniversalProbe 单个探针的配置
+type UniversalProbe struct {
+	Type CheckType `yaml:"type"`
+	Port int       `yaml:"port"`
+	// Path HTTP 路径，http 和 https 方式下，没有设置路径则关闭健康检查
+	Path string `yaml:"path"`
+	// Headers HTTP 请求头
+	Headers map[string]string `yaml:"headers"`
+	// Command exec 方式执行的命令
+	Command []string `yaml:"command"`
+	// Service grpc 方式检查的服务名，为空则检查整个服务器
+	Service  string `yaml:"service"`
 	Delay    int    `yaml:"delay"`
 	Interval int    `yaml:"interval"`
 	Success  int    `yaml:"success"`
@@ -27,33 +74,177 @@ type UniversalCheck struct {
 	Timeout  int    `yaml:"timeout"`
 }
 
-func (c UniversalCheck) GenerateReadinessProbe() *corev1.Probe {
-	_ = mergo.Merge(&c, defaultUniversalCheck)
-	if c.Path == "" {
+// GenerateHandler 生成探针的探测方式，未启用时返回 nil
+func (p UniversalProbe) GenerateHandler() *corev1.Handler {
+	switch p.Type {
+	case "", CheckTypeHTTP, CheckTypeHTTPS:
+		if p.Path == "" {
+			return nil
+		}
+		action := &corev1.HTTPGetAction{
+			Path:   p.Path,
+			Port:   intstr.FromInt(p.Port),
+			Scheme: corev1.URISchemeHTTP,
+		}
+		if p.Type == CheckTypeHTTPS {
+			action.Scheme = corev1.URISchemeHTTPS
+		}
+		var keys []string
+		for k := range p.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			action.HTTPHeaders = append(action.HTTPHeaders, corev1.HTTPHeader{Name: k, Value: p.Headers[k]})
+		}
+		return &corev1.Handler{HTTPGet: action}
+	case CheckTypeTCP:
+		return &corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(p.Port)}}
+	case CheckTypeExec:
+		if len(p.Command) == 0 {
+			return nil
+		}
+		return &corev1.Handler{Exec: &corev1.ExecAction{Command: p.Command}}
+	case CheckTypeGRPC:
+		command := []string{GRPCHealthProbeCommand, "-addr=:" + strconv.Itoa(p.Port)}
+		if p.Service != "" {
+			command = append(command, "-service="+p.Service)
+		}
+		return &corev1.Handler{Exec: &corev1.ExecAction{Command: command}}
+	}
+	return nil
+}
+
+// GenerateProbe 生成探针，未启用时返回 nil
+func (p UniversalProbe) GenerateProbe() *corev1.Probe {
+	handler := p.GenerateHandler()
+	if handler == nil {
 		return nil
 	}
-	b := &corev1.Probe{
-		InitialDelaySeconds: int32(c.Delay),
-		TimeoutSeconds:      int32(c.Timeout),
-		PeriodSeconds:       int32(c.Interval),
-		SuccessThreshold:    int32(c.Success),
-		FailureThreshold:    int32(c.Failure),
-		Handler: corev1.Handler{
-			HTTPGet: &corev1.HTTPGetAction{
-				Path:   c.Path,
-				Port:   intstr.FromInt(c.Port),
-				Scheme: "HTTP",
-			},
-		},
+	return &corev1.Probe{
+		InitialDelaySeconds: int32(p.Delay),
+		TimeoutSeconds:      int32(p.Timeout),
+		PeriodSeconds:       int32(p.Interval),
+		SuccessThreshold:    int32(p.Success),
+		FailureThreshold:    int32(p.Failure),
+		Handler:             *handler,
+	}
+}
+
+// probeTarget 返回只包含探测目标的配置，用于子配置继承
+func (p UniversalProbe) probeTarget() UniversalProbe {
+	return UniversalProbe{
+		Type:    p.Type,
+		Port:    p.Port,
+		Path:    p.Path,
+		Headers: p.Headers,
+		Command: p.Command,
+		Service: p.Service,
+		Timeout: p.Timeout,
+	}
+}
+
+// UniversalProbeOverride 存活，就绪或者启动探针的单独配置，可以设置为 false 单独关闭
+type UniversalProbeOverride struct {
+	UniversalProbe `yaml:",inline"`
+	// Disabled 关闭该探针，已经部署的探针也会被删除
+	Disabled bool `yaml:"disabled"`
+}
+
+func (o *UniversalProbeOverride) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var enabled bool
+	if err = unmarshal(&enabled); err == nil {
+		o.Disabled = !enabled
+		return
 	}
-	return b
+	type plain UniversalProbeOverride
+	err = unmarshal((*plain)(o))
+	return
+}
+
+const (
+	probeLiveness  = "livenessProbe"
+	probeReadiness = "readinessProbe"
+	probeStartup   = "startupProbe"
+)
+
+type UniversalCheck struct {
+	UniversalProbe `yaml:",inline"`
+	// Liveness 存活探针，继承顶层的所有字段
+	Liveness *UniversalProbeOverride `yaml:"liveness"`
+	// Readiness 就绪探针，继承顶层的所有字段
+	Readiness *UniversalProbeOverride `yaml:"readiness"`
+	// Startup 启动探针，继承顶层的探测目标，但是使用独立的阈值，适用于启动缓慢的应用
+	Startup *UniversalProbeOverride `yaml:"startup"`
+}
+
+func (c UniversalCheck) probe() UniversalProbe {
+	p := c.UniversalProbe
+	_ = mergo.Merge(&p, defaultUniversalCheck)
+	return p
+}
+
+// override 使用子配置覆盖顶层配置，子配置被关闭时返回 nil
+func (c UniversalCheck) override(o *UniversalProbeOverride) *UniversalProbe {
+	p := c.probe()
+	if o == nil {
+		return &p
+	}
+	if o.Disabled {
+		return nil
+	}
+	sub := o.UniversalProbe
+	_ = mergo.Merge(&sub, p)
+	return &sub
+}
+
+func (c UniversalCheck) GenerateReadinessProbe() *corev1.Probe {
+	p := c.override(c.Readiness)
+	if p == nil {
+		return nil
+	}
+	return p.GenerateProbe()
 }
 
 func (c UniversalCheck) GenerateLivenessProbe() *corev1.Probe {
-	p := c.GenerateReadinessProbe()
-	if p != nil {
+	p := c.override(c.Liveness)
+	if p == nil {
+		return nil
+	}
+	probe := p.GenerateProbe()
+	if probe != nil {
 		// LivenessProbe 强制要求 SuccessThreshold = 1
-		p.SuccessThreshold = 1
+		probe.SuccessThreshold = 1
 	}
-	return p
+	return probe
+}
+
+// GenerateStartupProbe 生成启动探针，没有设置 startup 时返回 nil
+func (c UniversalCheck) GenerateStartupProbe() *corev1.Probe {
+	if c.Startup == nil || c.Startup.Disabled {
+		return nil
+	}
+	p := c.Startup.UniversalProbe
+	_ = mergo.Merge(&p, c.probe().probeTarget())
+	_ = mergo.Merge(&p, defaultStartupProbe)
+	probe := p.GenerateProbe()
+	if probe != nil {
+		// StartupProbe 强制要求 SuccessThreshold = 1
+		probe.SuccessThreshold = 1
+	}
+	return probe
+}
+
+// DisabledProbes 返回被单独关闭的探针，部署时需要从工作负载中删除
+func (c UniversalCheck) DisabledProbes() (names []string) {
+	if c.Liveness != nil && c.Liveness.Disabled {
+		names = append(names, probeLiveness)
+	}
+	if c.Readiness != nil && c.Readiness.Disabled {
+		names = append(names, probeReadiness)
+	}
+	if c.Startup != nil && c.Startup.Disabled {
+		names = append(names, probeStartup)
+	}
+	return
 }
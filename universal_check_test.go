@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"testing"
+)
+
+func loadTestCheck(t *testing.T, s string) UniversalCheck {
+	var c UniversalCheck
+	require.NoError(t, yaml.UnmarshalStrict([]byte(s), &c))
+	return c
+}
+
+func TestUniversalCheck_HTTP(t *testing.T) {
+	c := loadTestCheck(t, `
+type: https
+path: /health
+headers:
+  X-Token: hello
+  Accept: application/json
+`)
+	p := c.GenerateReadinessProbe()
+	require.NotNil(t, p)
+	assert.Equal(t, corev1.URISchemeHTTPS, p.HTTPGet.Scheme)
+	assert.Equal(t, intstr.FromInt(8080), p.HTTPGet.Port)
+	assert.Equal(t, []corev1.HTTPHeader{
+		{Name: "Accept", Value: "application/json"},
+		{Name: "X-Token", Value: "hello"},
+	}, p.HTTPGet.HTTPHeaders)
+	assert.Equal(t, int32(60), p.InitialDelaySeconds)
+	assert.Equal(t, int32(2), p.FailureThreshold)
+
+	// 没有设置路径时关闭健康检查
+	assert.Nil(t, loadTestCheck(t, `port: 8080`).GenerateReadinessProbe())
+	assert.Nil(t, UniversalCheck{}.GenerateLivenessProbe())
+}
+
+func TestUniversalCheck_Types(t *testing.T) {
+	p := loadTestCheck(t, `
+type: tcp
+port: 3306
+`).GenerateLivenessProbe()
+	require.NotNil(t, p)
+	assert.Equal(t, intstr.FromInt(3306), p.TCPSocket.Port)
+	assert.Nil(t, p.HTTPGet)
+
+	p = loadTestCheck(t, `
+type: exec
+command: ["redis-cli", "ping"]
+`).GenerateReadinessProbe()
+	require.NotNil(t, p)
+	assert.Equal(t, []string{"redis-cli", "ping"}, p.Exec.Command)
+
+	assert.Nil(t, loadTestCheck(t, `type: exec`).GenerateReadinessProbe())
+
+	p = loadTestCheck(t, `
+type: grpc
+port: 9090
+service: hello.Greeter
+`).GenerateReadinessProbe()
+	require.NotNil(t, p)
+	assert.Equal(t, []string{"grpc_health_probe", "-addr=:9090", "-service=hello.Greeter"}, p.Exec.Command)
+
+	var c UniversalCheck
+	assert.Error(t, yaml.UnmarshalStrict([]byte(`type: udp`), &c))
+}
+
+func TestUniversalCheck_Startup(t *testing.T) {
+	c := loadTestCheck(t, `
+path: /health
+port: 3000
+delay: 10
+startup:
+  failure: 60
+`)
+	p := c.GenerateStartupProbe()
+	require.NotNil(t, p)
+	assert.Equal(t, "/health", p.HTTPGet.Path)
+	assert.Equal(t, intstr.FromInt(3000), p.HTTPGet.Port)
+	assert.Equal(t, int32(0), p.InitialDelaySeconds)
+	assert.Equal(t, int32(10), p.PeriodSeconds)
+	assert.Equal(t, int32(60), p.FailureThreshold)
+	assert.Equal(t, int32(1), p.SuccessThreshold)
+	assert.Equal(t, int32(5), p.TimeoutSeconds)
+
+	assert.Nil(t, loadTestCheck(t, `path: /health`).GenerateStartupProbe())
+}
+
+func TestUniversalCheck_LivenessReadiness(t *testing.T) {
+	c := loadTestCheck(t, `
+path: /health
+port: 3000
+failure: 2
+liveness:
+  path: /alive
+  failure: 5
+  delay: 120
+readiness:
+  failure: 1
+`)
+	l := c.GenerateLivenessProbe()
+	require.NotNil(t, l)
+	assert.Equal(t, "/alive", l.HTTPGet.Path)
+	assert.Equal(t, intstr.FromInt(3000), l.HTTPGet.Port)
+	assert.Equal(t, int32(5), l.FailureThreshold)
+	assert.Equal(t, int32(120), l.InitialDelaySeconds)
+	assert.Equal(t, int32(1), l.SuccessThreshold)
+
+	r := c.GenerateReadinessProbe()
+	require.NotNil(t, r)
+	assert.Equal(t, "/health", r.HTTPGet.Path)
+	assert.Equal(t, int32(1), r.FailureThreshold)
+	assert.Equal(t, int32(60), r.InitialDelaySeconds)
+	assert.Empty(t, c.DisabledProbes())
+}
+
+func TestUniversalCheck_Disabled(t *testing.T) {
+	c := loadTestCheck(t, `
+path: /health
+liveness: false
+startup:
+  disabled: true
+`)
+	assert.Nil(t, c.GenerateLivenessProbe())
+	assert.Nil(t, c.GenerateStartupProbe())
+	assert.NotNil(t, c.GenerateReadinessProbe())
+	assert.Equal(t, []string{"livenessProbe", "startupProbe"}, c.DisabledProbes())
+
+	// 设置为 true 时等同于未设置
+	c = loadTestCheck(t, `
+path: /health
+readiness: true
+`)
+	assert.NotNil(t, c.GenerateReadinessProbe())
+	assert.Empty(t, c.DisabledProbes())
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+const (
+	// LabelConfig 由 configs 字段生成的 ConfigMap 的标签，值为配置名
+	LabelConfig = "net.guoyk.deployer/config"
+
+	defaultConfigHistory = 3
+)
+
+var (
+	regexpConfigName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// UniversalConfigFile ConfigMap 中的单个文件
+type UniversalConfigFile struct {
+	// Key ConfigMap 中的键，即挂载后的文件名
+	Key string
+	// Path 代码仓库中的文件路径，相对于上下文目录，允许使用模板语言
+	Path string
+}
+
+// UniversalConfigFiles 文件列表，兼容 "KEY: PATH" 格式，直接使用路径时以文件名为键
+type UniversalConfigFiles []UniversalConfigFile
+
+func (fs *UniversalConfigFiles) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var m map[string]string
+	if err = unmarshal(&m); err == nil {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		*fs = nil
+		for _, k := range keys {
+			*fs = append(*fs, UniversalConfigFile{Key: k, Path: m[k]})
+		}
+		return
+	}
+	var paths []string
+	if err = unmarshal(&paths); err != nil {
+		return
+	}
+	*fs = nil
+	for _, p := range paths {
+		*fs = append(*fs, UniversalConfigFile{Key: filepath.Base(p), Path: p})
+	}
+	return
+}
+
+// UniversalConfig 从代码仓库中的文件生成的 ConfigMap，名称包含内容哈希，内容变化时会触发滚动更新
+type UniversalConfig struct {
+	// Name 配置名，生成的 ConfigMap 名称为 "工作负载名-配置名-哈希"
+	Name string `yaml:"name"`
+	// Files 文件列表，文件内容使用模板语言渲染
+	Files UniversalConfigFiles `yaml:"files"`
+	// MountPath 容器内的挂载目录
+	MountPath string `yaml:"mountPath"`
+	// History 保留的版本数量，包括当前版本，默认为 3，更早的版本会被删除
+	History int `yaml:"history"`
+}
+
+func (c *UniversalConfig) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	type plain UniversalConfig
+	if err = unmarshal((*plain)(c)); err != nil {
+		return
+	}
+	if !regexpConfigName.MatchString(c.Name) {
+		err = fmt.Errorf("配置名格式不正确，只能包含小写字母，数字和 -: %s", c.Name)
+		return
+	}
+	if len(c.Files) == 0 {
+		err = fmt.Errorf("配置 %s 缺少 files 字段", c.Name)
+		return
+	}
+	if c.MountPath == "" {
+		err = fmt.Errorf("配置 %s 缺少 mountPath 字段", c.Name)
+		return
+	}
+	if c.History < 0 {
+		err = errors.New("configs.history 不能为负数")
+		return
+	}
+	return
+}
+
+// VolumeName 挂载 ConfigMap 使用的卷名
+func (c UniversalConfig) VolumeName() string {
+	return "config-" + c.Name
+}
+
+// ConfigMap 由 deployer2 生成的 ConfigMap
+type ConfigMap struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+// hashConfigData 计算 ConfigMap 内容的哈希，与键的顺序无关
+func hashConfigData(data map[string]string) string {
+	var keys []string
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(data[k]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:10]
+}
+
+// Generate 渲染文件路径和文件内容，生成 ConfigMap，文件路径相对于 dir
+func (c UniversalConfig) Generate(profile *Profile, dir string, workload *UniversalWorkload) (cm ConfigMap, err error) {
+	cm.Data = map[string]string{}
+	for _, f := range c.Files {
+		if _, ok := cm.Data[f.Key]; ok {
+			err = fmt.Errorf("配置 %s 中的文件名重复: %s", c.Name, f.Key)
+			return
+		}
+		var path string
+		if path, err = profile.RenderString(f.Path); err != nil {
+			return
+		}
+		var buf []byte
+		if buf, err = ioutil.ReadFile(filepath.Join(dir, path)); err != nil {
+			return
+		}
+		if buf, err = profile.Render(string(buf)); err != nil {
+			return
+		}
+		cm.Data[f.Key] = string(buf)
+	}
+	cm.APIVersion = "v1"
+	cm.Kind = "ConfigMap"
+	cm.Metadata.Name = workload.Name + "-" + c.Name + "-" + hashConfigData(cm.Data)
+	cm.Metadata.Namespace = workload.Namespace
+	cm.Metadata.Labels = map[string]string{
+		LabelManagedBy: LabelManagedByValue,
+		LabelWorkload:  workload.Name,
+		LabelConfig:    c.Name,
+	}
+	return
+}
+
+// Selector 选择该配置所有版本的标签选择器
+func (c UniversalConfig) Selector(workload *UniversalWorkload) string {
+	return LabelManagedBy + "=" + LabelManagedByValue + "," +
+		LabelWorkload + "=" + workload.Name + "," +
+		LabelConfig + "=" + c.Name
+}
+
+// Stale 在 kubectl get configmaps -o json 的输出中，找出超出保留数量的旧版本，当前版本始终保留
+func (c UniversalConfig) Stale(buf []byte, current string) (names []string, err error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name              string `json:"name"`
+				CreationTimestamp string `json:"creationTimestamp"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(buf, &list); err != nil {
+		return
+	}
+	items := list.Items
+	// RFC3339 格式的时间可以直接按照字符串比较，最新的在前
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Metadata.CreationTimestamp > items[j].Metadata.CreationTimestamp
+	})
+	history := c.History
+	if history == 0 {
+		history = defaultConfigHistory
+	}
+	kept := 1
+	for _, item := range items {
+		if item.Metadata.Name == current {
+			continue
+		}
+		if kept < history {
+			kept++
+			continue
+		}
+		names = append(names, item.Metadata.Name)
+	}
+	return
+}
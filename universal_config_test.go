@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUniversalConfig_Generate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deployer2-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "config"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config", "prod.yaml"), []byte("env: {{.Profile}}\nlevel: {{.Vars.level}}\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config", "logback.xml"), []byte("<configuration/>"), 0644))
+
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  vars:
+    level: info
+  configs:
+    - name: app
+      files:
+        config.yaml: config/{{.Profile}}.yaml
+      mountPath: /app/config
+    - name: logging
+      files:
+        - config/logback.xml
+      mountPath: /app/logging
+      history: 5
+`), &m))
+	p, err := m.Profile("prod")
+	require.NoError(t, err)
+	require.Len(t, p.Configs, 2)
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	cm, err := p.Configs[0].Generate(&p, dir, &w)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"config.yaml": "env: prod\nlevel: info\n"}, cm.Data)
+	assert.Regexp(t, `^hello-app-[0-9a-f]{10}$`, cm.Metadata.Name)
+	assert.Equal(t, "default", cm.Metadata.Namespace)
+	assert.Equal(t, "app", cm.Metadata.Labels[LabelConfig])
+	assert.Equal(t, "hello", cm.Metadata.Labels[LabelWorkload])
+
+	// 内容变化时名称变化
+	p.Vars["level"] = "debug"
+	cm2, err := p.Configs[0].Generate(&p, dir, &w)
+	require.NoError(t, err)
+	assert.NotEqual(t, cm.Metadata.Name, cm2.Metadata.Name)
+
+	cm, err = p.Configs[1].Generate(&p, dir, &w)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"logback.xml": "<configuration/>"}, cm.Data)
+	assert.Equal(t, "app.kubernetes.io/managed-by=deployer2,net.guoyk.deployer/workload=hello,net.guoyk.deployer/config=logging", p.Configs[1].Selector(&w))
+}
+
+func TestUniversalConfig_UnmarshalYAML(t *testing.T) {
+	var m Manifest
+	assert.Error(t, LoadManifest([]byte(`
+version: 2
+default:
+  configs:
+    - name: App_Config
+      files: [a.yaml]
+      mountPath: /app
+`), &m))
+	assert.Error(t, LoadManifest([]byte(`
+version: 2
+default:
+  configs:
+    - name: app
+      files: [a.yaml]
+`), &m))
+}
+
+func TestUniversalConfig_Stale(t *testing.T) {
+	buf := []byte(`{"items":[
+  {"metadata":{"name":"hello-app-1","creationTimestamp":"2020-01-01T00:00:00Z"}},
+  {"metadata":{"name":"hello-app-4","creationTimestamp":"2020-01-04T00:00:00Z"}},
+  {"metadata":{"name":"hello-app-2","creationTimestamp":"2020-01-02T00:00:00Z"}},
+  {"metadata":{"name":"hello-app-3","creationTimestamp":"2020-01-03T00:00:00Z"}}
+]}`)
+	names, err := UniversalConfig{Name: "app"}.Stale(buf, "hello-app-2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello-app-1"}, names)
+
+	names, err = UniversalConfig{Name: "app", History: 1}.Stale(buf, "hello-app-5")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello-app-4", "hello-app-3", "hello-app-2", "hello-app-1"}, names)
+}
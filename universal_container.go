@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UniversalPort 容器端口，兼容直接使用端口号
+type UniversalPort struct {
+	Name string `yaml:"name"`
+	Port int    `yaml:"port"`
+	// Protocol 协议，可以为 TCP (默认), UDP, SCTP
+	Protocol string `yaml:"protocol"`
+}
+
+func (p *UniversalPort) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var port int
+	if err = unmarshal(&port); err == nil {
+		p.Port = port
+		return
+	}
+	type plain UniversalPort
+	if err = unmarshal((*plain)(p)); err != nil {
+		return
+	}
+	if p.Port <= 0 {
+		err = fmt.Errorf("容器端口 %s 缺少 port 字段", p.Name)
+		return
+	}
+	return
+}
+
+// UniversalPorts 容器端口列表，以 containerPort 为合并键，不会影响工作负载中的其他端口
+type UniversalPorts []UniversalPort
+
+func (ps UniversalPorts) Generate() (out []corev1.ContainerPort) {
+	for _, p := range ps {
+		protocol := corev1.ProtocolTCP
+		if p.Protocol != "" {
+			protocol = corev1.Protocol(strings.ToUpper(p.Protocol))
+		}
+		out = append(out, corev1.ContainerPort{
+			Name:          p.Name,
+			ContainerPort: int32(p.Port),
+			Protocol:      protocol,
+		})
+	}
+	return
+}
+
+// UniversalEnvVar 容器环境变量，只能设置 value, secret, configMap 其中之一
+type UniversalEnvVar struct {
+	Name string `yaml:"name"`
+	// Value 字面值，允许使用模板语言，比如 {{.Vars.env}}
+	Value string `yaml:"value"`
+	// Secret 引用 Secret 中的键，格式为 "NAME#KEY"
+	Secret string `yaml:"secret"`
+	// ConfigMap 引用 ConfigMap 中的键，格式为 "NAME#KEY"
+	ConfigMap string `yaml:"configMap"`
+}
+
+func splitKeyRef(ref string) (name string, key string, err error) {
+	splits := strings.SplitN(ref, "#", 2)
+	if len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+		err = fmt.Errorf("引用格式不正确，应为 \"NAME#KEY\": %s", ref)
+		return
+	}
+	name, key = splits[0], splits[1]
+	return
+}
+
+// Generate 生成环境变量，render 用于渲染字面值
+func (e UniversalEnvVar) Generate(render func(string) (string, error)) (out corev1.EnvVar, err error) {
+	out.Name = e.Name
+	if out.Name == "" {
+		err = errors.New("环境变量缺少 name 字段")
+		return
+	}
+	var count int
+	if e.Secret != "" {
+		count++
+	}
+	if e.ConfigMap != "" {
+		count++
+	}
+	if count > 1 || (count == 1 && e.Value != "") {
+		err = fmt.Errorf("环境变量 %s 只能设置 value, secret, configMap 其中之一", e.Name)
+		return
+	}
+	var name, key string
+	switch {
+	case e.Secret != "":
+		if name, key, err = splitKeyRef(e.Secret); err != nil {
+			return
+		}
+		out.ValueFrom = &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		}}
+	case e.ConfigMap != "":
+		if name, key, err = splitKeyRef(e.ConfigMap); err != nil {
+			return
+		}
+		out.ValueFrom = &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		}}
+	default:
+		if out.Value, err = render(e.Value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// UniversalEnv 容器环境变量列表，以 name 为合并键，不会影响工作负载中的其他环境变量，兼容 "KEY: VALUE" 格式
+type UniversalEnv []UniversalEnvVar
+
+func (e *UniversalEnv) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var m map[string]string
+	if err = unmarshal(&m); err == nil {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		*e = nil
+		for _, k := range keys {
+			*e = append(*e, UniversalEnvVar{Name: k, Value: m[k]})
+		}
+		return
+	}
+	var vars []UniversalEnvVar
+	if err = unmarshal(&vars); err != nil {
+		return
+	}
+	*e = vars
+	return
+}
+
+func (e UniversalEnv) Generate(render func(string) (string, error)) (out []corev1.EnvVar, err error) {
+	for _, v := range e {
+		var ev corev1.EnvVar
+		if ev, err = v.Generate(render); err != nil {
+			return
+		}
+		out = append(out, ev)
+	}
+	return
+}
+
+// UniversalPreStop 容器停止前执行的钩子，只能设置 command, path, sleep 其中之一，兼容直接使用命令数组
+type UniversalPreStop struct {
+	// Command 执行的命令
+	Command []string `yaml:"command"`
+	// Path HTTP GET 请求的路径
+	Path string `yaml:"path"`
+	// Port HTTP GET 请求的端口，默认为健康检查端口
+	Port int `yaml:"port"`
+	// Sleep 等待的秒数，常用于等待负载均衡摘除流量
+	Sleep int `yaml:"sleep"`
+}
+
+func (p *UniversalPreStop) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var command []string
+	if err = unmarshal(&command); err == nil {
+		p.Command = command
+		return
+	}
+	type plain UniversalPreStop
+	err = unmarshal((*plain)(p))
+	return
+}
+
+// Generate 生成 lifecycle 字段，defaultPort 为 HTTP 请求的默认端口
+func (p UniversalPreStop) Generate(defaultPort int) (out *corev1.Lifecycle, err error) {
+	var count int
+	if len(p.Command) > 0 {
+		count++
+	}
+	if p.Path != "" {
+		count++
+	}
+	if p.Sleep > 0 {
+		count++
+	}
+	if count != 1 {
+		err = errors.New("preStop 必须且只能设置 command, path, sleep 其中之一")
+		return
+	}
+	handler := &corev1.Handler{}
+	switch {
+	case len(p.Command) > 0:
+		handler.Exec = &corev1.ExecAction{Command: p.Command}
+	case p.Path != "":
+		port := p.Port
+		if port == 0 {
+			port = defaultPort
+		}
+		handler.HTTPGet = &corev1.HTTPGetAction{Path: p.Path, Port: intstr.FromInt(port), Scheme: corev1.URISchemeHTTP}
+	default:
+		handler.Exec = &corev1.ExecAction{Command: []string{"sleep", strconv.Itoa(p.Sleep)}}
+	}
+	out = &corev1.Lifecycle{PreStop: handler}
+	return
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// IngressAPIVersion 优先使用的 Ingress API 版本，集群不支持时使用 IngressAPIVersionBeta
+	IngressAPIVersion     = "networking.k8s.io/v1"
+	IngressAPIVersionBeta = "networking.k8s.io/v1beta1"
+
+	// annotationIngressClass 旧版本 Ingress 指定 IngressClass 的注解
+	annotationIngressClass = "kubernetes.io/ingress.class"
+)
+
+// UniversalIngressPath 路径规则，兼容直接使用路径
+type UniversalIngressPath struct {
+	Path string `yaml:"path"`
+	// PathType 匹配方式，可以为 Prefix (默认), Exact, ImplementationSpecific
+	PathType string `yaml:"pathType"`
+	// Service 后端 Service 名称，默认为 service 字段维护的 Service
+	Service string `yaml:"service"`
+	// Port 后端 Service 端口，默认为 Service 的第一个端口
+	Port int `yaml:"port"`
+}
+
+func (p *UniversalIngressPath) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var path string
+	if err = unmarshal(&path); err == nil {
+		p.Path = path
+		return
+	}
+	type plain UniversalIngressPath
+	err = unmarshal((*plain)(p))
+	return
+}
+
+// UniversalIngressTLS TLS 配置
+type UniversalIngressTLS struct {
+	// Secret 证书所在的 Secret 名称
+	Secret string `yaml:"secret"`
+	// Hosts 使用该证书的域名，默认为 ingress 的所有域名
+	Hosts []string `yaml:"hosts"`
+}
+
+// UniversalIngress 与工作负载同时维护的 Ingress
+type UniversalIngress struct {
+	// Name Ingress 名称，默认为工作负载名
+	Name string `yaml:"name"`
+	// ClassName IngressClass 名称
+	ClassName   string            `yaml:"className"`
+	Annotations map[string]string `yaml:"annotations"`
+	// Hosts 域名列表，允许使用模板语言，为空则匹配所有域名
+	Hosts []string `yaml:"hosts"`
+	// Paths 路径规则，默认为 "/"
+	Paths []UniversalIngressPath `yaml:"paths"`
+	TLS   []UniversalIngressTLS  `yaml:"tls"`
+}
+
+type ingressBackend struct {
+	// Service networking.k8s.io/v1 格式
+	Service *ingressServiceBackend `json:"service,omitempty"`
+	// ServiceName 和 ServicePort networking.k8s.io/v1beta1 格式
+	ServiceName string `json:"serviceName,omitempty"`
+	ServicePort int32  `json:"servicePort,omitempty"`
+}
+
+type ingressServiceBackend struct {
+	Name string `json:"name"`
+	Port struct {
+		Number int32 `json:"number"`
+	} `json:"port"`
+}
+
+type ingressPath struct {
+	Path     string         `json:"path"`
+	PathType string         `json:"pathType,omitempty"`
+	Backend  ingressBackend `json:"backend"`
+}
+
+type ingressRule struct {
+	Host string `json:"host,omitempty"`
+	HTTP struct {
+		Paths []ingressPath `json:"paths"`
+	} `json:"http"`
+}
+
+type ingressTLS struct {
+	Hosts      []string `json:"hosts,omitempty"`
+	SecretName string   `json:"secretName"`
+}
+
+// Ingress networking.k8s.io/v1 和 networking.k8s.io/v1beta1 通用的 Ingress，只包含 deployer2 管理的字段
+type Ingress struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		IngressClassName string        `json:"ingressClassName,omitempty"`
+		TLS              []ingressTLS  `json:"tls,omitempty"`
+		Rules            []ingressRule `json:"rules"`
+	} `json:"spec"`
+}
+
+// SelectIngressAPIVersion 根据集群支持的 API 版本选择 Ingress 的 API 版本
+func SelectIngressAPIVersion(versions []string) string {
+	for _, v := range versions {
+		if v == IngressAPIVersion {
+			return IngressAPIVersion
+		}
+	}
+	return IngressAPIVersionBeta
+}
+
+// Generate 生成 Ingress，service 为默认的后端 Service，render 用于渲染域名
+func (in UniversalIngress) Generate(apiVersion string, workload *UniversalWorkload, service Service, render func(string) (string, error)) (out Ingress, err error) {
+	out.APIVersion = apiVersion
+	out.Kind = "Ingress"
+	out.Metadata.Name = in.Name
+	if out.Metadata.Name == "" {
+		out.Metadata.Name = workload.Name
+	}
+	out.Metadata.Namespace = workload.Namespace
+	out.Metadata.Labels = map[string]string{
+		LabelManagedBy: LabelManagedByValue,
+		LabelWorkload:  workload.Name,
+	}
+	out.Metadata.Annotations = map[string]string{}
+	for k, v := range in.Annotations {
+		out.Metadata.Annotations[k] = v
+	}
+	if in.ClassName != "" {
+		if apiVersion == IngressAPIVersion {
+			out.Spec.IngressClassName = in.ClassName
+		} else {
+			out.Metadata.Annotations[annotationIngressClass] = in.ClassName
+		}
+	}
+
+	var hosts []string
+	for _, h := range in.Hosts {
+		if h, err = render(h); err != nil {
+			return
+		}
+		hosts = append(hosts, h)
+	}
+
+	paths := in.Paths
+	if len(paths) == 0 {
+		paths = []UniversalIngressPath{{Path: "/"}}
+	}
+	var ips []ingressPath
+	for _, p := range paths {
+		ip := ingressPath{Path: p.Path, PathType: p.PathType}
+		if ip.Path == "" {
+			ip.Path = "/"
+		}
+		// 旧版本的 Ingress 不一定支持 pathType，只在明确设置时输出
+		if ip.PathType == "" && apiVersion == IngressAPIVersion {
+			ip.PathType = "Prefix"
+		}
+		name, port := p.Service, int32(p.Port)
+		if name == "" {
+			name = service.Metadata.Name
+		}
+		if port == 0 {
+			if len(service.Spec.Ports) == 0 {
+				err = fmt.Errorf("Ingress 路径 %s 缺少 port 字段", ip.Path)
+				return
+			}
+			port = service.Spec.Ports[0].Port
+		}
+		if apiVersion == IngressAPIVersion {
+			ip.Backend.Service = &ingressServiceBackend{Name: name}
+			ip.Backend.Service.Port.Number = port
+		} else {
+			ip.Backend.ServiceName, ip.Backend.ServicePort = name, port
+		}
+		ips = append(ips, ip)
+	}
+
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	for _, h := range hosts {
+		rule := ingressRule{Host: h}
+		rule.HTTP.Paths = ips
+		out.Spec.Rules = append(out.Spec.Rules, rule)
+	}
+
+	for _, t := range in.TLS {
+		if t.Secret == "" {
+			err = fmt.Errorf("ingress.tls 缺少 secret 字段")
+			return
+		}
+		tls := ingressTLS{SecretName: t.Secret}
+		for _, h := range t.Hosts {
+			if h, err = render(h); err != nil {
+				return
+			}
+			tls.Hosts = append(tls.Hosts, h)
+		}
+		if len(tls.Hosts) == 0 {
+			for _, h := range hosts {
+				if h != "" {
+					tls.Hosts = append(tls.Hosts, h)
+				}
+			}
+		}
+		out.Spec.TLS = append(out.Spec.TLS, tls)
+	}
+	return
+}
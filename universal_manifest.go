@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+const (
+	// FieldManager server-side apply 使用的字段管理者
+	FieldManager = "deployer2"
+)
+
+// UniversalManifest 原始的 Kubernetes 资源模板，兼容直接使用模板内容
+type UniversalManifest struct {
+	// File 模板文件路径，相对于上下文目录，允许使用模板语言
+	File string `yaml:"file"`
+	// Content 模板内容
+	Content string `yaml:"content"`
+}
+
+func (m *UniversalManifest) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var content string
+	if err = unmarshal(&content); err == nil {
+		m.Content = content
+		return
+	}
+	type plain UniversalManifest
+	if err = unmarshal((*plain)(m)); err != nil {
+		return
+	}
+	if (m.File == "") == (m.Content == "") {
+		err = fmt.Errorf("manifests 必须且只能设置 file 和 content 其中之一")
+		return
+	}
+	return
+}
+
+// Name 用于日志的名称
+func (m UniversalManifest) Name(index int) string {
+	if m.File != "" {
+		return m.File
+	}
+	return fmt.Sprintf("manifests[%d]", index)
+}
+
+// Render 渲染模板，模板中可以额外使用 .Workload 和 .Image，渲染结果为空时返回 nil
+func (m UniversalManifest) Render(profile *Profile, dir string, workload *UniversalWorkload, imageName string) (out []byte, err error) {
+	src := m.Content
+	if m.File != "" {
+		var path string
+		if path, err = profile.RenderString(m.File); err != nil {
+			return
+		}
+		var buf []byte
+		if buf, err = ioutil.ReadFile(filepath.Join(dir, path)); err != nil {
+			return
+		}
+		src = string(buf)
+	}
+	if out, err = profile.RenderWith(src, map[string]interface{}{
+		"Workload": workload,
+		"Image":    imageName,
+	}); err != nil {
+		return
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		out = nil
+	}
+	return
+}
+
+// SecretPlaceholder 不加载秘密值时，.Secrets 中的值渲染为该占位符
+func SecretPlaceholder(name string) string {
+	return "<secret:" + name + ">"
+}
+
+// PrintManifests 渲染所有目标工作负载的 manifests 字段并输出，不访问集群，也不加载秘密值，
+// 调用方需要自行对 out 做脱敏处理
+func PrintManifests(out io.Writer, u *Unit) (err error) {
+	u.Profile.RegisterSensitive()
+	profile := u.Profile
+	if len(profile.Secrets) > 0 && profile.SecretValues == nil {
+		log.Printf("警告: 不加载秘密值，.Secrets 渲染为占位符 %s", SecretPlaceholder("名称"))
+		profile.SecretValues = map[string]string{}
+		for name := range profile.Secrets {
+			profile.SecretValues[name] = SecretPlaceholder(name)
+		}
+	}
+	for _, workload := range u.Workloads {
+		var preset Preset
+		if err = LoadPresetFromHome(workload.Cluster, &preset); err != nil {
+			return
+		}
+		imageName := u.ImageNames.Derive(preset.Registry).Primary()
+		for i, m := range u.Profile.Manifests {
+			var buf []byte
+			if buf, err = m.Render(&profile, u.Dir, &workload, imageName); err != nil {
+				return
+			}
+			if buf == nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(out, "---\n# %s: %s\n%s\n", workload.String(), m.Name(i), bytes.TrimSpace(buf)); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"github.com/acicn/deployer2/pkg/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testManifestsManifest = `
+version: 2
+default:
+  vars:
+    minAvailable: 1
+  workloads:
+    - test/default/deployment/hello
+  manifests:
+    - |
+      apiVersion: policy/v1beta1
+      kind: PodDisruptionBudget
+      metadata:
+        name: {{.Workload.Name}}
+      spec:
+        minAvailable: {{.Vars.minAvailable}}
+        selector:
+          matchLabels:
+            net.guoyk.deployer/workload: {{.Workload.Name}}
+    - file: k8s/{{.Profile}}.yaml
+    - |
+      {{if eq .Profile "prod"}}
+      kind: NetworkPolicy
+      {{end}}
+`
+
+func TestUniversalManifest_Render(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "k8s"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, "k8s", "test.yaml"), []byte("# image: {{.Image}}\n"), 0644))
+
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(testManifestsManifest), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	require.Len(t, p.Manifests, 3)
+	assert.Equal(t, "manifests[0]", p.Manifests[0].Name(0))
+	assert.Equal(t, "k8s/{{.Profile}}.yaml", p.Manifests[1].Name(1))
+
+	w := p.Workloads[0]
+	buf, err := p.Manifests[0].Render(&p, home, &w, "hello:test")
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), "name: hello\n")
+	assert.Contains(t, string(buf), "minAvailable: 1\n")
+
+	buf, err = p.Manifests[1].Render(&p, home, &w, "hello:test")
+	require.NoError(t, err)
+	assert.Equal(t, "# image: hello:test\n", string(buf))
+
+	// 渲染结果为空
+	buf, err = p.Manifests[2].Render(&p, home, &w, "hello:test")
+	require.NoError(t, err)
+	assert.Nil(t, buf)
+
+	u := &Unit{Dir: home, Profile: p, ImageNames: NewImageNames("hello", "test", "1"), Workloads: p.Workloads}
+	out := &bytes.Buffer{}
+	require.NoError(t, PrintManifests(out, u))
+	assert.Contains(t, out.String(), "---\n# test/default/hello/hello: manifests[0]\napiVersion: policy/v1beta1\n")
+	assert.Contains(t, out.String(), "# image: registry.example.com/hello/hello:test-build-1\n")
+	assert.NotContains(t, out.String(), "manifests[2]")
+}
+
+func TestPrintManifests_Sensitive(t *testing.T) {
+	home, restore := setupTestHome(t)
+	defer restore()
+	defer redact.Reset()
+
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  vars:
+    token: hello-token-value
+  sensitive:
+    vars: [token]
+  secrets:
+    password:
+      vault: secret/data/hello#password
+  workloads:
+    - test/default/deployment/hello
+  manifests:
+    - |
+      token: {{.Vars.token}}
+      password: {{.Secrets.password}}
+`), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+
+	u := &Unit{Dir: home, Profile: p, ImageNames: NewImageNames("hello", "test", "1"), Workloads: p.Workloads}
+	buf := &bytes.Buffer{}
+	out := redact.NewLineWriter(buf)
+	require.NoError(t, PrintManifests(out, u))
+	require.NoError(t, out.Flush())
+	assert.Contains(t, buf.String(), "token: "+redact.Mask+"\n")
+	assert.Contains(t, buf.String(), "password: <secret:password>\n")
+	assert.NotContains(t, buf.String(), "hello-token-value")
+}
+
+func TestUniversalManifest_UnmarshalYAML(t *testing.T) {
+	var m Manifest
+	assert.Error(t, LoadManifest([]byte(`
+version: 2
+default:
+  manifests:
+    - file: a.yaml
+      content: "kind: Service"
+`), &m))
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"sort"
 	"strings"
 	"time"
 )
@@ -12,21 +15,133 @@ type UniversalPatch struct {
 		Annotations map[string]string `json:"annotations,omitempty"`
 	} `json:"metadata,omitempty"`
 	Spec struct {
+		// Replicas 副本数，只在 Deployment 和 StatefulSet 上设置，并且没有设置自动伸缩时才设置
+		Replicas *int32 `json:"replicas,omitempty"`
 		Template struct {
 			Metadata struct {
+				Labels      map[string]string `json:"labels,omitempty"`
 				Annotations map[string]string `json:"annotations,omitempty"`
 			} `json:"metadata,omitempty"`
 			Spec corev1.PodSpec `json:"spec,omitempty"`
 		} `json:"template,omitempty"`
 	} `json:"spec,omitempty"`
+
+	// removedProbes 需要从容器中删除的探针，在补丁中设置为 null
+	removedProbes []string
+}
+
+// patchItems 返回通用结构中列表字段的所有对象
+func patchItems(v interface{}) (out []map[string]interface{}) {
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			out = append(out, m)
+		}
+	}
+	return
 }
 
-func CreateUniversalPatch(preset *Preset, profile *Profile, workload *UniversalWorkload, imageName string) UniversalPatch {
-	var p UniversalPatch
-	p.Metadata.Annotations = preset.Annotations
+// handlerKeys 探针和 preStop 钩子的执行方式，只能设置其中之一
+var handlerKeys = []string{"exec", "httpGet", "tcpSocket"}
+
+// clearUnusedHandlers 将补丁中没有使用的执行方式设置为 null，避免与工作负载中原有的执行方式合并后同时存在
+func clearUnusedHandlers(handler map[string]interface{}) {
+	for _, key := range handlerKeys {
+		if _, ok := handler[key]; !ok {
+			handler[key] = nil
+		}
+	}
+}
+
+// MarshalJSON 生成补丁，被关闭的探针会设置为 null，以便从工作负载中删除，探针中未使用的探测方式同样设置为 null；
+// 没有设置 preStop 时 lifecycle 设置为 null，preStop 中未使用的执行方式同样设置为 null，
+// 环境变量以 name 为合并键，value 和 valueFrom 中未使用的一个设置为 null，避免切换来源后两者同时存在，
+// 卷同样以 name 为合并键，使用 $retainKeys 删除补丁中没有的来源
+func (p UniversalPatch) MarshalJSON() (buf []byte, err error) {
+	type plain UniversalPatch
+	if buf, err = json.Marshal(plain(p)); err != nil {
+		return
+	}
+	if len(p.Spec.Template.Spec.Containers) == 0 && len(p.Spec.Template.Spec.InitContainers) == 0 && len(p.Spec.Template.Spec.Volumes) == 0 {
+		return
+	}
+	// 解码为通用结构，只修改 spec.template.spec 中的容器和卷，其余字段原样保留，使用 json.Number 避免数字精度丢失
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err = dec.Decode(&m); err != nil {
+		return
+	}
+	spec, _ := m["spec"].(map[string]interface{})
+	template, _ := spec["template"].(map[string]interface{})
+	podSpec, _ := template["spec"].(map[string]interface{})
+	for _, container := range patchItems(podSpec["containers"]) {
+		for _, name := range p.removedProbes {
+			container[name] = nil
+		}
+		for _, name := range []string{"livenessProbe", "readinessProbe", "startupProbe"} {
+			if probe, ok := container[name].(map[string]interface{}); ok {
+				clearUnusedHandlers(probe)
+			}
+		}
+		if lifecycle, ok := container["lifecycle"].(map[string]interface{}); ok {
+			if preStop, ok := lifecycle["preStop"].(map[string]interface{}); ok {
+				clearUnusedHandlers(preStop)
+			}
+		} else {
+			container["lifecycle"] = nil
+		}
+	}
+	for _, key := range []string{"initContainers", "containers"} {
+		for _, container := range patchItems(podSpec[key]) {
+			for _, env := range patchItems(container["env"]) {
+				if _, ok := env["valueFrom"]; ok {
+					env["value"] = nil
+				} else {
+					env["valueFrom"] = nil
+					if _, ok := env["value"]; !ok {
+						env["value"] = nil
+					}
+				}
+			}
+		}
+	}
+	for _, volume := range patchItems(podSpec["volumes"]) {
+		var keys []string
+		for k := range volume {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		volume["$retainKeys"] = keys
+	}
+	return json.Marshal(m)
+}
+
+func CreateUniversalPatch(preset *Preset, profile *Profile, workload *UniversalWorkload, imageName string) (p UniversalPatch, err error) {
+	// 环境变量的字面值允许使用模板语言
+	var env []corev1.EnvVar
+	if env, err = profile.Env.Generate(profile.RenderString); err != nil {
+		return
+	}
+	var mounts []corev1.VolumeMount
+	if p.Spec.Template.Spec.Volumes, mounts, err = profile.Volumes.Generate(); err != nil {
+		return
+	}
+	p.Metadata.Annotations = map[string]string{}
+	for k, v := range preset.Annotations {
+		p.Metadata.Annotations[k] = v
+	}
+	if profile.Replicas != nil && profile.Autoscale == nil && workload.Scalable() {
+		replicas := int32(*profile.Replicas)
+		p.Spec.Replicas = &replicas
+	}
 	p.Spec.Template.Metadata.Annotations = map[string]string{
 		"net.guoyk.deployer/timestamp": time.Now().Format(time.RFC3339),
 	}
+	p.Spec.Template.Metadata.Labels = map[string]string{
+		LabelWorkload: workload.Name,
+	}
+	profile.Scheduling.Merge(preset.Scheduling).Apply(&p.Spec.Template.Spec, workload)
 	for _, name := range preset.ImagePullSecrets {
 		secret := corev1.LocalObjectReference{Name: strings.TrimSpace(name)}
 		p.Spec.Template.Spec.ImagePullSecrets = append(p.Spec.Template.Spec.ImagePullSecrets, secret)
@@ -36,6 +151,10 @@ func CreateUniversalPatch(preset *Preset, profile *Profile, workload *UniversalW
 			Image:           imageName,
 			Name:            workload.Container,
 			ImagePullPolicy: "Always",
+			Command:         profile.Command,
+			Args:            profile.Args,
+			Env:             env,
+			VolumeMounts:    mounts,
 		}
 		p.Spec.Template.Spec.InitContainers = append(p.Spec.Template.Spec.InitContainers, container)
 	} else {
@@ -43,6 +162,16 @@ func CreateUniversalPatch(preset *Preset, profile *Profile, workload *UniversalW
 			Image:           imageName,
 			Name:            workload.Container,
 			ImagePullPolicy: "Always",
+			Command:         profile.Command,
+			Args:            profile.Args,
+			Env:             env,
+			VolumeMounts:    mounts,
+			Ports:           profile.Ports.Generate(),
+		}
+		if profile.PreStop != nil {
+			if container.Lifecycle, err = profile.PreStop.Generate(profile.Check.probe().Port); err != nil {
+				return
+			}
 		}
 		if container.Resources.Requests == nil {
 			container.Resources.Requests = map[corev1.ResourceName]resource.Quantity{}
@@ -71,10 +200,13 @@ func CreateUniversalPatch(preset *Preset, profile *Profile, workload *UniversalW
 				container.Resources.Limits[corev1.ResourceMemory] = mem.AsMEM()
 		}
 		if !workload.Labels.NoCheck {
+			// 只生成设置了的探针，单独关闭的探针需要删除
 			container.LivenessProbe = profile.Check.GenerateLivenessProbe()
 			container.ReadinessProbe = profile.Check.GenerateReadinessProbe()
+			container.StartupProbe = profile.Check.GenerateStartupProbe()
+			p.removedProbes = profile.Check.DisabledProbes()
 		}
 		p.Spec.Template.Spec.Containers = append(p.Spec.Template.Spec.Containers, container)
 	}
-	return p
+	return
 }
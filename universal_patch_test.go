@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"testing"
+)
+
+func TestCreateUniversalPatch_Probes(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  check:
+    path: /health
+    readiness: false
+`), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	buf, err := json.Marshal(patch)
+	require.NoError(t, err)
+
+	var out struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					Containers []map[string]interface{} `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(buf, &out))
+	require.Len(t, out.Spec.Template.Spec.Containers, 1)
+	container := out.Spec.Template.Spec.Containers[0]
+	assert.NotNil(t, container["livenessProbe"])
+	// 单独关闭的探针设置为 null，以便从工作负载中删除
+	v, ok := container["readinessProbe"]
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	// 未设置的探针不出现在补丁中
+	_, ok = container["startupProbe"]
+	assert.False(t, ok)
+	assert.Equal(t, "hello:test", container["image"])
+}
+
+func TestCreateUniversalPatch_ProbesWithOtherFields(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  replicas: 3
+  check:
+    path: /health
+    liveness: false
+  volumes:
+    - name: data
+      emptyDir: true
+      mountPath: /data
+`), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	patch, err := CreateUniversalPatch(&Preset{Annotations: map[string]string{"team": "hello"}}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	buf, err := json.Marshal(patch)
+	require.NoError(t, err)
+
+	// 关闭探针时，补丁的其他字段保持不变
+	var out struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Replicas *int32 `json:"replicas"`
+			Template struct {
+				Metadata struct {
+					Labels      map[string]string `json:"labels"`
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+				Spec struct {
+					Volumes    []corev1.Volume          `json:"volumes"`
+					Containers []map[string]interface{} `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(buf, &out))
+	assert.Equal(t, "hello", out.Metadata.Annotations["team"])
+	require.NotNil(t, out.Spec.Replicas)
+	assert.Equal(t, int32(3), *out.Spec.Replicas)
+	assert.Equal(t, "hello", out.Spec.Template.Metadata.Labels[LabelWorkload])
+	assert.NotEmpty(t, out.Spec.Template.Metadata.Annotations["net.guoyk.deployer/timestamp"])
+	require.Len(t, out.Spec.Template.Spec.Volumes, 1)
+	assert.Equal(t, "data", out.Spec.Template.Spec.Volumes[0].Name)
+	require.Len(t, out.Spec.Template.Spec.Containers, 1)
+	container := out.Spec.Template.Spec.Containers[0]
+	v, ok := container["livenessProbe"]
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	assert.NotNil(t, container["readinessProbe"])
+	assert.NotEmpty(t, container["volumeMounts"])
+}
+
+func TestUniversalPatch_MarshalJSON_ProbeType(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  check:
+    port: 3000
+    path: /health
+    startup: {}
+test:
+  check:
+    type: tcp
+prod:
+  check:
+    type: exec
+    command: ["redis-cli", "ping"]
+`), &m))
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	containers := func(profile string) []map[string]interface{} {
+		p, err := m.Profile(profile)
+		require.NoError(t, err)
+		patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:"+profile)
+		require.NoError(t, err)
+		buf, err := json.Marshal(patch)
+		require.NoError(t, err)
+		var out struct {
+			Spec struct {
+				Template struct {
+					Spec struct {
+						Containers []map[string]interface{} `json:"containers"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		require.NoError(t, json.Unmarshal(buf, &out))
+		require.Len(t, out.Spec.Template.Spec.Containers, 1)
+		return out.Spec.Template.Spec.Containers
+	}
+
+	// 从 http 切换到其他探测方式时，补丁删除工作负载中原有的 httpGet，否则合并后同时存在多个探测方式
+	for profile, used := range map[string]string{"test": "tcpSocket", "prod": "exec"} {
+		container := containers(profile)[0]
+		for _, name := range []string{"livenessProbe", "readinessProbe", "startupProbe"} {
+			probe, ok := container[name].(map[string]interface{})
+			require.True(t, ok, "%s %s", profile, name)
+			for _, key := range []string{"exec", "httpGet", "tcpSocket"} {
+				v, ok := probe[key]
+				assert.True(t, ok, "%s %s %s", profile, name, key)
+				if key == used {
+					assert.NotNil(t, v, "%s %s %s", profile, name, key)
+				} else {
+					assert.Nil(t, v, "%s %s %s", profile, name, key)
+				}
+			}
+		}
+	}
+}
+
+func TestCreateUniversalPatch_Container(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  check:
+    port: 3000
+    path: /health
+  ports:
+    - 3000
+    - name: metrics
+      port: 9100
+      protocol: udp
+  env:
+    - name: APP_ENV
+      value: "{{.Profile}}"
+    - name: DB_PASSWORD
+      secret: hello-db#password
+    - name: FEATURES
+      configMap: hello-config#features
+  command: ["node"]
+  args: ["server.js", "--port", "3000"]
+  preStop:
+    sleep: 10
+test:
+  env:
+    LOG_LEVEL: debug
+    APP_ENV: "test-{{.Vars.suffix}}"
+  vars:
+    suffix: a
+  preStop:
+    path: /shutdown
+`), &m))
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	p, err := m.Profile("prod")
+	require.NoError(t, err)
+	patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:prod")
+	require.NoError(t, err)
+	c := patch.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, []corev1.ContainerPort{
+		{ContainerPort: 3000, Protocol: corev1.ProtocolTCP},
+		{Name: "metrics", ContainerPort: 9100, Protocol: corev1.ProtocolUDP},
+	}, c.Ports)
+	require.Len(t, c.Env, 3)
+	assert.Equal(t, corev1.EnvVar{Name: "APP_ENV", Value: "prod"}, c.Env[0])
+	assert.Equal(t, "hello-db", c.Env[1].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, "password", c.Env[1].ValueFrom.SecretKeyRef.Key)
+	assert.Equal(t, "hello-config", c.Env[2].ValueFrom.ConfigMapKeyRef.Name)
+	assert.Equal(t, []string{"node"}, c.Command)
+	assert.Equal(t, []string{"server.js", "--port", "3000"}, c.Args)
+	assert.Equal(t, []string{"sleep", "10"}, c.Lifecycle.PreStop.Exec.Command)
+
+	p, err = m.Profile("test")
+	require.NoError(t, err)
+	patch, err = CreateUniversalPatch(&Preset{}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	c = patch.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "APP_ENV", Value: "test-a"},
+		{Name: "LOG_LEVEL", Value: "debug"},
+	}, c.Env)
+	assert.Equal(t, "/shutdown", c.Lifecycle.PreStop.HTTPGet.Path)
+	assert.Equal(t, intstr.FromInt(3000), c.Lifecycle.PreStop.HTTPGet.Port)
+}
+
+func TestUniversalPatch_MarshalJSON_EnvSource(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  env:
+    - name: DB_PASSWORD
+      value: plain
+    - name: EMPTY
+      value: ""
+test:
+  env:
+    - name: DB_PASSWORD
+      secret: hello-db#password
+`), &m))
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	env := func(profile string) map[string]map[string]interface{} {
+		p, err := m.Profile(profile)
+		require.NoError(t, err)
+		patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:"+profile)
+		require.NoError(t, err)
+		buf, err := json.Marshal(patch)
+		require.NoError(t, err)
+		var out struct {
+			Spec struct {
+				Template struct {
+					Spec struct {
+						Containers []struct {
+							Env []map[string]interface{} `json:"env"`
+						} `json:"containers"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		require.NoError(t, json.Unmarshal(buf, &out))
+		require.Len(t, out.Spec.Template.Spec.Containers, 1)
+		vars := map[string]map[string]interface{}{}
+		for _, v := range out.Spec.Template.Spec.Containers[0].Env {
+			vars[v["name"].(string)] = v
+		}
+		return vars
+	}
+
+	// 从字面值切换到 Secret 引用时，补丁删除原有的 value，否则合并后 value 和 valueFrom 同时存在
+	vars := env("test")
+	assert.Contains(t, vars["DB_PASSWORD"], "value")
+	assert.Nil(t, vars["DB_PASSWORD"]["value"])
+	assert.NotNil(t, vars["DB_PASSWORD"]["valueFrom"])
+
+	// 从 Secret 引用切换回字面值时，补丁删除原有的 valueFrom
+	vars = env("prod")
+	assert.Equal(t, "plain", vars["DB_PASSWORD"]["value"])
+	assert.Contains(t, vars["DB_PASSWORD"], "valueFrom")
+	assert.Nil(t, vars["DB_PASSWORD"]["valueFrom"])
+
+	// 空字面值同时删除 value 和 valueFrom
+	assert.Contains(t, vars["EMPTY"], "value")
+	assert.Nil(t, vars["EMPTY"]["value"])
+	assert.Contains(t, vars["EMPTY"], "valueFrom")
+	assert.Nil(t, vars["EMPTY"]["valueFrom"])
+}
+
+func TestUniversalPatch_MarshalJSON_PreStop(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  check:
+    port: 3000
+    path: /health
+test:
+  preStop:
+    sleep: 10
+prod:
+  preStop:
+    path: /shutdown
+`), &m))
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	container := func(profile string) map[string]interface{} {
+		p, err := m.Profile(profile)
+		require.NoError(t, err)
+		patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:"+profile)
+		require.NoError(t, err)
+		buf, err := json.Marshal(patch)
+		require.NoError(t, err)
+		var out struct {
+			Spec struct {
+				Template struct {
+					Spec struct {
+						Containers []map[string]interface{} `json:"containers"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		require.NoError(t, json.Unmarshal(buf, &out))
+		require.Len(t, out.Spec.Template.Spec.Containers, 1)
+		return out.Spec.Template.Spec.Containers[0]
+	}
+	preStop := func(profile string) map[string]interface{} {
+		lifecycle, ok := container(profile)["lifecycle"].(map[string]interface{})
+		require.True(t, ok)
+		v, ok := lifecycle["preStop"].(map[string]interface{})
+		require.True(t, ok)
+		return v
+	}
+
+	// 在 exec 和 httpGet 之间切换时，补丁删除工作负载中原有的执行方式
+	h := preStop("test")
+	assert.NotNil(t, h["exec"])
+	assert.Contains(t, h, "httpGet")
+	assert.Nil(t, h["httpGet"])
+	h = preStop("prod")
+	assert.NotNil(t, h["httpGet"])
+	assert.Contains(t, h, "exec")
+	assert.Nil(t, h["exec"])
+
+	// 没有设置 preStop 时，从工作负载中删除
+	c := container("staging")
+	assert.Contains(t, c, "lifecycle")
+	assert.Nil(t, c["lifecycle"])
+}
+
+func TestUniversalEnvVar_Generate(t *testing.T) {
+	render := func(s string) (string, error) { return s, nil }
+	_, err := UniversalEnvVar{Name: "A", Value: "x", Secret: "s#k"}.Generate(render)
+	assert.Error(t, err)
+	_, err = UniversalEnvVar{Name: "A", Secret: "s"}.Generate(render)
+	assert.Error(t, err)
+	_, err = UniversalEnvVar{Value: "x"}.Generate(render)
+	assert.Error(t, err)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+const (
+	// LabelWorkload Pod 模板上标记所属工作负载的标签，用于反亲和性和拓扑分布的选择器
+	LabelWorkload = "net.guoyk.deployer/workload"
+
+	AntiAffinityPreferred = "preferred"
+	AntiAffinityRequired  = "required"
+)
+
+var (
+	// topologyKeyAliases 拓扑键的简写
+	topologyKeyAliases = map[string]string{
+		"hostname": "kubernetes.io/hostname",
+		"zone":     "topology.kubernetes.io/zone",
+		"region":   "topology.kubernetes.io/region",
+	}
+)
+
+func expandTopologyKey(key string) string {
+	if v, ok := topologyKeyAliases[key]; ok {
+		return v
+	}
+	return key
+}
+
+// UniversalToleration 容忍，兼容 "KEY=VALUE:EFFECT", "KEY:EFFECT" 和 "KEY" 格式
+type UniversalToleration struct {
+	Key string `yaml:"key"`
+	// Operator 可以为 Equal 或者 Exists，没有设置 value 时默认为 Exists
+	Operator string `yaml:"operator"`
+	Value    string `yaml:"value"`
+	// Effect 可以为 NoSchedule, PreferNoSchedule, NoExecute，为空代表所有
+	Effect string `yaml:"effect"`
+}
+
+func (t *UniversalToleration) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err == nil {
+		if splits := strings.SplitN(s, ":", 2); len(splits) == 2 {
+			s, t.Effect = splits[0], splits[1]
+		}
+		if splits := strings.SplitN(s, "=", 2); len(splits) == 2 {
+			s, t.Value = splits[0], splits[1]
+		}
+		t.Key = s
+		return
+	}
+	type plain UniversalToleration
+	err = unmarshal((*plain)(t))
+	return
+}
+
+func (t UniversalToleration) Generate() (out corev1.Toleration) {
+	out.Key = t.Key
+	out.Value = t.Value
+	out.Effect = corev1.TaintEffect(t.Effect)
+	out.Operator = corev1.TolerationOperator(t.Operator)
+	if out.Operator == "" {
+		if t.Value == "" {
+			out.Operator = corev1.TolerationOpExists
+		} else {
+			out.Operator = corev1.TolerationOpEqual
+		}
+	}
+	return
+}
+
+// UniversalAntiAffinity 同一工作负载的 Pod 之间的反亲和性，兼容直接使用 mode
+type UniversalAntiAffinity struct {
+	// Mode 可以为 preferred (尽量分散) 或者 required (必须分散)
+	Mode string `yaml:"mode"`
+	// TopologyKey 拓扑键，默认为 hostname，可以使用 hostname, zone, region 简写
+	TopologyKey string `yaml:"topologyKey"`
+}
+
+func (a *UniversalAntiAffinity) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var mode string
+	if err = unmarshal(&mode); err == nil {
+		a.Mode = mode
+	} else {
+		type plain UniversalAntiAffinity
+		if err = unmarshal((*plain)(a)); err != nil {
+			return
+		}
+	}
+	switch a.Mode {
+	case AntiAffinityPreferred, AntiAffinityRequired:
+	default:
+		err = fmt.Errorf("不支持的反亲和性模式: %s, 只能为 preferred 或者 required", a.Mode)
+	}
+	return
+}
+
+func (a UniversalAntiAffinity) Generate(workload *UniversalWorkload) *corev1.Affinity {
+	topologyKey := a.TopologyKey
+	if topologyKey == "" {
+		topologyKey = "hostname"
+	}
+	term := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{LabelWorkload: workload.Name}},
+		TopologyKey:   expandTopologyKey(topologyKey),
+	}
+	anti := &corev1.PodAntiAffinity{}
+	if a.Mode == AntiAffinityRequired {
+		anti.RequiredDuringSchedulingIgnoredDuringExecution = []corev1.PodAffinityTerm{term}
+	} else {
+		anti.PreferredDuringSchedulingIgnoredDuringExecution = []corev1.WeightedPodAffinityTerm{{Weight: 100, PodAffinityTerm: term}}
+	}
+	return &corev1.Affinity{PodAntiAffinity: anti}
+}
+
+// UniversalSpread 拓扑分布约束，兼容直接使用拓扑键
+type UniversalSpread struct {
+	// TopologyKey 拓扑键，可以使用 hostname, zone, region 简写
+	TopologyKey string `yaml:"topologyKey"`
+	// MaxSkew 最大偏差，默认为 1
+	MaxSkew int `yaml:"maxSkew"`
+	// WhenUnsatisfiable 无法满足时的行为，可以为 ScheduleAnyway (默认) 或者 DoNotSchedule
+	WhenUnsatisfiable string `yaml:"whenUnsatisfiable"`
+}
+
+func (s *UniversalSpread) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var key string
+	if err = unmarshal(&key); err == nil {
+		s.TopologyKey = key
+		return
+	}
+	type plain UniversalSpread
+	if err = unmarshal((*plain)(s)); err != nil {
+		return
+	}
+	if s.TopologyKey == "" {
+		err = fmt.Errorf("拓扑分布约束缺少 topologyKey 字段")
+		return
+	}
+	return
+}
+
+func (s UniversalSpread) Generate(workload *UniversalWorkload) (out corev1.TopologySpreadConstraint) {
+	out.TopologyKey = expandTopologyKey(s.TopologyKey)
+	out.MaxSkew = int32(s.MaxSkew)
+	if out.MaxSkew == 0 {
+		out.MaxSkew = 1
+	}
+	out.WhenUnsatisfiable = corev1.UnsatisfiableConstraintAction(s.WhenUnsatisfiable)
+	if out.WhenUnsatisfiable == "" {
+		out.WhenUnsatisfiable = corev1.ScheduleAnyway
+	}
+	out.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{LabelWorkload: workload.Name}}
+	return
+}
+
+// UniversalScheduling Pod 调度配置，可以在集群预置文件和环境配置中设置
+type UniversalScheduling struct {
+	// NodeSelector 节点选择器，与集群预置文件按键合并
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+	// Tolerations 容忍，追加在集群预置文件之后
+	Tolerations []UniversalToleration `yaml:"tolerations"`
+	// AntiAffinity 同一工作负载的 Pod 之间的反亲和性，覆盖集群预置文件
+	AntiAffinity *UniversalAntiAffinity `yaml:"antiAffinity"`
+	// Spread 拓扑分布约束，以 topologyKey 与集群预置文件合并
+	Spread []UniversalSpread `yaml:"spread"`
+}
+
+// Merge 使用当前配置覆盖集群预置文件中的配置
+func (s UniversalScheduling) Merge(preset UniversalScheduling) (out UniversalScheduling) {
+	if len(preset.NodeSelector) > 0 || len(s.NodeSelector) > 0 {
+		out.NodeSelector = map[string]string{}
+		for k, v := range preset.NodeSelector {
+			out.NodeSelector[k] = v
+		}
+		for k, v := range s.NodeSelector {
+			out.NodeSelector[k] = v
+		}
+	}
+	out.Tolerations = append(append(out.Tolerations, preset.Tolerations...), s.Tolerations...)
+	out.AntiAffinity = preset.AntiAffinity
+	if s.AntiAffinity != nil {
+		out.AntiAffinity = s.AntiAffinity
+	}
+	keys := map[string]bool{}
+	for _, spread := range s.Spread {
+		keys[expandTopologyKey(spread.TopologyKey)] = true
+	}
+	for _, spread := range preset.Spread {
+		if !keys[expandTopologyKey(spread.TopologyKey)] {
+			out.Spread = append(out.Spread, spread)
+		}
+	}
+	out.Spread = append(out.Spread, s.Spread...)
+	return
+}
+
+// Apply 将调度配置写入 Pod 模板
+func (s UniversalScheduling) Apply(spec *corev1.PodSpec, workload *UniversalWorkload) {
+	spec.NodeSelector = s.NodeSelector
+	for _, t := range s.Tolerations {
+		spec.Tolerations = append(spec.Tolerations, t.Generate())
+	}
+	if s.AntiAffinity != nil {
+		spec.Affinity = s.AntiAffinity.Generate(workload)
+	}
+	for _, spread := range s.Spread {
+		spec.TopologySpreadConstraints = append(spec.TopologySpreadConstraints, spread.Generate(workload))
+	}
+}
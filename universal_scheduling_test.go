@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCreateUniversalPatch_Scheduling(t *testing.T) {
+	var preset Preset
+	require.NoError(t, LoadPreset([]byte(`
+scheduling:
+  nodeSelector:
+    pool: default
+    arch: amd64
+  tolerations:
+    - dedicated=app:NoSchedule
+  antiAffinity: preferred
+  spread:
+    - zone
+`), &preset))
+
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  scheduling:
+    nodeSelector:
+      pool: batch
+    tolerations:
+      - key: gpu
+        effect: NoExecute
+    antiAffinity:
+      mode: required
+      topologyKey: zone
+    spread:
+      - topologyKey: zone
+        maxSkew: 2
+        whenUnsatisfiable: DoNotSchedule
+      - hostname
+`), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	patch, err := CreateUniversalPatch(&preset, &p, &w, "hello:test")
+	require.NoError(t, err)
+	buf, err := json.Marshal(patch.Spec.Template)
+	require.NoError(t, err)
+
+	var out struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec map[string]interface{} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(buf, &out))
+	assert.Equal(t, "hello", out.Metadata.Labels[LabelWorkload])
+
+	expected := `{
+  "nodeSelector": {"pool": "batch", "arch": "amd64"},
+  "tolerations": [
+    {"key": "dedicated", "operator": "Equal", "value": "app", "effect": "NoSchedule"},
+    {"key": "gpu", "operator": "Exists", "effect": "NoExecute"}
+  ],
+  "affinity": {"podAntiAffinity": {"requiredDuringSchedulingIgnoredDuringExecution": [
+    {"labelSelector": {"matchLabels": {"net.guoyk.deployer/workload": "hello"}}, "topologyKey": "topology.kubernetes.io/zone"}
+  ]}},
+  "topologySpreadConstraints": [
+    {"maxSkew": 2, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "DoNotSchedule", "labelSelector": {"matchLabels": {"net.guoyk.deployer/workload": "hello"}}},
+    {"maxSkew": 1, "topologyKey": "kubernetes.io/hostname", "whenUnsatisfiable": "ScheduleAnyway", "labelSelector": {"matchLabels": {"net.guoyk.deployer/workload": "hello"}}}
+  ]
+}`
+	actual := map[string]interface{}{}
+	for _, k := range []string{"nodeSelector", "tolerations", "affinity", "topologySpreadConstraints"} {
+		actual[k] = out.Spec[k]
+	}
+	buf, err = json.Marshal(actual)
+	require.NoError(t, err)
+	assert.JSONEq(t, expected, string(buf))
+}
+
+func TestUniversalAntiAffinity_UnmarshalYAML(t *testing.T) {
+	var m Manifest
+	err := LoadManifest([]byte(`
+version: 2
+default:
+  scheduling:
+    antiAffinity: always
+`), &m)
+	assert.Error(t, err)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"strings"
+)
+
+// UniversalServicePort Service 端口，兼容直接使用端口号
+type UniversalServicePort struct {
+	Name string `yaml:"name"`
+	Port int    `yaml:"port"`
+	// TargetPort 容器端口，默认与 port 相同
+	TargetPort int `yaml:"targetPort"`
+	// Protocol 协议，可以为 TCP (默认), UDP, SCTP
+	Protocol string `yaml:"protocol"`
+}
+
+func (p *UniversalServicePort) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var port int
+	if err = unmarshal(&port); err == nil {
+		p.Port = port
+		return
+	}
+	type plain UniversalServicePort
+	if err = unmarshal((*plain)(p)); err != nil {
+		return
+	}
+	if p.Port <= 0 {
+		err = fmt.Errorf("Service 端口 %s 缺少 port 字段", p.Name)
+		return
+	}
+	return
+}
+
+// UniversalService 与工作负载同时维护的 Service，选择带有 net.guoyk.deployer/workload 标签的 Pod
+type UniversalService struct {
+	// Name Service 名称，默认为工作负载名
+	Name string `yaml:"name"`
+	// Type 类型，可以为 ClusterIP (默认), NodePort, LoadBalancer
+	Type        string            `yaml:"type"`
+	Annotations map[string]string `yaml:"annotations"`
+	// Ports 端口列表，默认为健康检查端口
+	Ports []UniversalServicePort `yaml:"ports"`
+}
+
+// ServiceName 返回 Service 名称
+func (s UniversalService) ServiceName(workload *UniversalWorkload) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return workload.Name
+}
+
+// Generate 生成 Service，defaultPort 为没有设置 ports 时使用的端口
+func (s UniversalService) Generate(workload *UniversalWorkload, defaultPort int) (out Service) {
+	out.APIVersion = "v1"
+	out.Kind = "Service"
+	out.Metadata.Name = s.ServiceName(workload)
+	out.Metadata.Namespace = workload.Namespace
+	out.Metadata.Labels = map[string]string{
+		LabelManagedBy: LabelManagedByValue,
+		LabelWorkload:  workload.Name,
+	}
+	out.Metadata.Annotations = s.Annotations
+	out.Spec.Type = s.Type
+	out.Spec.Selector = map[string]string{LabelWorkload: workload.Name}
+	ports := s.Ports
+	if len(ports) == 0 {
+		ports = []UniversalServicePort{{Name: "http", Port: defaultPort}}
+	}
+	for _, p := range ports {
+		targetPort := p.TargetPort
+		if targetPort == 0 {
+			targetPort = p.Port
+		}
+		protocol := corev1.ProtocolTCP
+		if p.Protocol != "" {
+			protocol = corev1.Protocol(strings.ToUpper(p.Protocol))
+		}
+		out.Spec.Ports = append(out.Spec.Ports, corev1.ServicePort{
+			Name:       p.Name,
+			Port:       int32(p.Port),
+			TargetPort: intstr.FromInt(targetPort),
+			Protocol:   protocol,
+		})
+	}
+	return
+}
+
+// Service deployer2 创建的 Service
+type Service struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Type     string               `json:"type,omitempty"`
+		Selector map[string]string    `json:"selector"`
+		Ports    []corev1.ServicePort `json:"ports"`
+	} `json:"spec"`
+}
+
+// IsManaged 判断 kubectl get -o json 输出的资源是否由 deployer2 创建，资源不存在时 buf 为空
+func IsManaged(buf []byte) (exists bool, managed bool, err error) {
+	if len(strings.TrimSpace(string(buf))) == 0 {
+		return
+	}
+	exists = true
+	var obj struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err = json.Unmarshal(buf, &obj); err != nil {
+		return
+	}
+	managed = obj.Metadata.Labels[LabelManagedBy] == LabelManagedByValue
+	return
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const testServiceManifest = `
+version: 2
+default:
+  check:
+    port: 3000
+    path: /health
+  service:
+    ports:
+      - 80
+      - name: grpc
+        port: 9090
+        targetPort: 19090
+  ingress:
+    className: nginx
+    hosts:
+      - "hello.{{.Profile}}.example.com"
+    paths:
+      - /
+      - path: /rpc
+        port: 9090
+    tls:
+      - secret: hello-tls
+`
+
+func TestUniversalService_Generate(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(testServiceManifest), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	svc := p.Service.Generate(&w, p.Check.probe().Port)
+	buf, err := json.Marshal(svc)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+  "apiVersion": "v1",
+  "kind": "Service",
+  "metadata": {"name": "hello", "namespace": "default", "labels": {"app.kubernetes.io/managed-by": "deployer2", "net.guoyk.deployer/workload": "hello"}},
+  "spec": {
+    "selector": {"net.guoyk.deployer/workload": "hello"},
+    "ports": [
+      {"protocol": "TCP", "port": 80, "targetPort": 80},
+      {"name": "grpc", "protocol": "TCP", "port": 9090, "targetPort": 19090}
+    ]
+  }
+}`, string(buf))
+
+	ingress, err := p.Ingress.Generate(IngressAPIVersion, &w, svc, p.RenderString)
+	require.NoError(t, err)
+	buf, err = json.Marshal(ingress)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+  "apiVersion": "networking.k8s.io/v1",
+  "kind": "Ingress",
+  "metadata": {"name": "hello", "namespace": "default", "labels": {"app.kubernetes.io/managed-by": "deployer2", "net.guoyk.deployer/workload": "hello"}},
+  "spec": {
+    "ingressClassName": "nginx",
+    "tls": [{"hosts": ["hello.test.example.com"], "secretName": "hello-tls"}],
+    "rules": [{"host": "hello.test.example.com", "http": {"paths": [
+      {"path": "/", "pathType": "Prefix", "backend": {"service": {"name": "hello", "port": {"number": 80}}}},
+      {"path": "/rpc", "pathType": "Prefix", "backend": {"service": {"name": "hello", "port": {"number": 9090}}}}
+    ]}}]
+  }
+}`, string(buf))
+
+	ingress, err = p.Ingress.Generate(SelectIngressAPIVersion([]string{"networking.k8s.io/v1beta1"}), &w, svc, p.RenderString)
+	require.NoError(t, err)
+	buf, err = json.Marshal(ingress)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+  "apiVersion": "networking.k8s.io/v1beta1",
+  "kind": "Ingress",
+  "metadata": {"name": "hello", "namespace": "default", "labels": {"app.kubernetes.io/managed-by": "deployer2", "net.guoyk.deployer/workload": "hello"}, "annotations": {"kubernetes.io/ingress.class": "nginx"}},
+  "spec": {
+    "tls": [{"hosts": ["hello.test.example.com"], "secretName": "hello-tls"}],
+    "rules": [{"host": "hello.test.example.com", "http": {"paths": [
+      {"path": "/", "backend": {"serviceName": "hello", "servicePort": 80}},
+      {"path": "/rpc", "backend": {"serviceName": "hello", "servicePort": 9090}}
+    ]}}]
+  }
+}`, string(buf))
+}
+
+func TestIsManaged(t *testing.T) {
+	exists, managed, err := IsManaged([]byte("\n"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.False(t, managed)
+
+	exists, managed, err = IsManaged([]byte(`{"metadata":{"labels":{"app":"hello"}}}`))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.False(t, managed)
+
+	exists, managed, err = IsManaged([]byte(`{"metadata":{"labels":{"app.kubernetes.io/managed-by":"deployer2"}}}`))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, managed)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// UniversalEmptyDir 临时目录，兼容直接使用 true
+type UniversalEmptyDir struct {
+	// Medium 存储介质，为空使用节点磁盘，Memory 使用内存
+	Medium string `yaml:"medium"`
+	// SizeLimit 容量限制，比如 1Gi
+	SizeLimit string `yaml:"sizeLimit"`
+}
+
+func (d *UniversalEmptyDir) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var enabled bool
+	if err = unmarshal(&enabled); err == nil {
+		if !enabled {
+			err = errors.New("emptyDir 不能设置为 false")
+		}
+		return
+	}
+	type plain UniversalEmptyDir
+	err = unmarshal((*plain)(d))
+	return
+}
+
+func (d UniversalEmptyDir) Generate() (out *corev1.EmptyDirVolumeSource, err error) {
+	out = &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMedium(d.Medium)}
+	if d.SizeLimit != "" {
+		var q resource.Quantity
+		if q, err = resource.ParseQuantity(d.SizeLimit); err != nil {
+			err = fmt.Errorf("emptyDir.sizeLimit 格式不正确: %s", d.SizeLimit)
+			return
+		}
+		out.SizeLimit = &q
+	}
+	return
+}
+
+// UniversalVolume 卷和挂载点，只能设置 configMap, secret, emptyDir, pvc 其中之一
+type UniversalVolume struct {
+	// Name 卷名，作为合并键，不影响工作负载中的其他卷
+	Name string `yaml:"name"`
+	// MountPath 容器内的挂载路径
+	MountPath string `yaml:"mountPath"`
+	// SubPath 只挂载卷中的某个文件或者目录，常用于挂载单个配置文件
+	SubPath  string `yaml:"subPath"`
+	ReadOnly bool   `yaml:"readOnly"`
+	// ConfigMap 引用的 ConfigMap 名称
+	ConfigMap string `yaml:"configMap"`
+	// Secret 引用的 Secret 名称
+	Secret string `yaml:"secret"`
+	// EmptyDir 临时目录
+	EmptyDir *UniversalEmptyDir `yaml:"emptyDir"`
+	// PVC 引用的 PersistentVolumeClaim 名称
+	PVC string `yaml:"pvc"`
+}
+
+func (v UniversalVolume) Generate() (volume corev1.Volume, mount corev1.VolumeMount, err error) {
+	if v.Name == "" {
+		err = errors.New("卷缺少 name 字段")
+		return
+	}
+	if v.MountPath == "" {
+		err = fmt.Errorf("卷 %s 缺少 mountPath 字段", v.Name)
+		return
+	}
+	var count int
+	for _, s := range []string{v.ConfigMap, v.Secret, v.PVC} {
+		if s != "" {
+			count++
+		}
+	}
+	if v.EmptyDir != nil {
+		count++
+	}
+	if count != 1 {
+		err = fmt.Errorf("卷 %s 必须且只能设置 configMap, secret, emptyDir, pvc 其中之一", v.Name)
+		return
+	}
+	volume.Name = v.Name
+	switch {
+	case v.ConfigMap != "":
+		volume.ConfigMap = &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: v.ConfigMap}}
+	case v.Secret != "":
+		volume.Secret = &corev1.SecretVolumeSource{SecretName: v.Secret}
+	case v.PVC != "":
+		volume.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{ClaimName: v.PVC, ReadOnly: v.ReadOnly}
+	default:
+		if volume.EmptyDir, err = v.EmptyDir.Generate(); err != nil {
+			return
+		}
+	}
+	mount = corev1.VolumeMount{
+		Name:      v.Name,
+		MountPath: v.MountPath,
+		SubPath:   v.SubPath,
+		ReadOnly:  v.ReadOnly,
+	}
+	return
+}
+
+// UniversalVolumes 卷列表，卷以 name 合并，挂载点以 mountPath 合并
+type UniversalVolumes []UniversalVolume
+
+func (vs UniversalVolumes) Generate() (volumes []corev1.Volume, mounts []corev1.VolumeMount, err error) {
+	names := map[string]bool{}
+	for _, v := range vs {
+		var volume corev1.Volume
+		var mount corev1.VolumeMount
+		if volume, mount, err = v.Generate(); err != nil {
+			return
+		}
+		if names[v.Name] {
+			err = fmt.Errorf("卷名重复: %s", v.Name)
+			return
+		}
+		names[v.Name] = true
+		volumes = append(volumes, volume)
+		mounts = append(mounts, mount)
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCreateUniversalPatch_Volumes(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  volumes:
+    - name: config
+      configMap: hello-config
+      mountPath: /app/config.yaml
+      subPath: config.yaml
+      readOnly: true
+    - name: tls
+      secret: hello-tls
+      mountPath: /etc/tls
+    - name: scratch
+      emptyDir: true
+      mountPath: /tmp
+    - name: cache
+      emptyDir:
+        medium: Memory
+        sizeLimit: 256Mi
+      mountPath: /cache
+    - name: data
+      pvc: hello-data
+      mountPath: /data
+`), &m))
+	p, err := m.Profile("test")
+	require.NoError(t, err)
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:test")
+	require.NoError(t, err)
+	spec := patch.Spec.Template.Spec
+	buf, err := json.Marshal(spec.Volumes)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+  {"name": "config", "configMap": {"name": "hello-config"}},
+  {"name": "tls", "secret": {"secretName": "hello-tls"}},
+  {"name": "scratch", "emptyDir": {}},
+  {"name": "cache", "emptyDir": {"medium": "Memory", "sizeLimit": "256Mi"}},
+  {"name": "data", "persistentVolumeClaim": {"claimName": "hello-data"}}
+]`, string(buf))
+	require.Len(t, spec.Containers, 1)
+	buf, err = json.Marshal(spec.Containers[0].VolumeMounts)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+  {"name": "config", "mountPath": "/app/config.yaml", "subPath": "config.yaml", "readOnly": true},
+  {"name": "tls", "mountPath": "/etc/tls"},
+  {"name": "scratch", "mountPath": "/tmp"},
+  {"name": "cache", "mountPath": "/cache"},
+  {"name": "data", "mountPath": "/data"}
+]`, string(buf))
+}
+
+func TestUniversalVolumes_Generate(t *testing.T) {
+	_, _, err := UniversalVolumes{{Name: "a", MountPath: "/a", ConfigMap: "a", Secret: "a"}}.Generate()
+	assert.Error(t, err)
+	_, _, err = UniversalVolumes{{Name: "a", ConfigMap: "a"}}.Generate()
+	assert.Error(t, err)
+	_, _, err = UniversalVolumes{
+		{Name: "a", MountPath: "/a", ConfigMap: "a"},
+		{Name: "a", MountPath: "/b", Secret: "b"},
+	}.Generate()
+	assert.Error(t, err)
+	_, _, err = UniversalVolumes{{Name: "a", MountPath: "/a", EmptyDir: &UniversalEmptyDir{SizeLimit: "lots"}}}.Generate()
+	assert.Error(t, err)
+}
+
+func TestUniversalPatch_MarshalJSON_VolumeSource(t *testing.T) {
+	var m Manifest
+	require.NoError(t, LoadManifest([]byte(`
+version: 2
+default:
+  volumes:
+    - name: config
+      configMap: hello-config
+      mountPath: /app/config
+test:
+  volumes:
+    - name: config
+      secret: hello-config
+      mountPath: /app/config
+`), &m))
+	var w UniversalWorkload
+	require.NoError(t, w.Set("test/default/deployment/hello"))
+
+	volumes := func(profile string) string {
+		p, err := m.Profile(profile)
+		require.NoError(t, err)
+		patch, err := CreateUniversalPatch(&Preset{}, &p, &w, "hello:"+profile)
+		require.NoError(t, err)
+		buf, err := json.Marshal(patch)
+		require.NoError(t, err)
+		var out struct {
+			Spec struct {
+				Template struct {
+					Spec struct {
+						Volumes json.RawMessage `json:"volumes"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		require.NoError(t, json.Unmarshal(buf, &out))
+		return string(out.Spec.Template.Spec.Volumes)
+	}
+
+	// 同名的卷切换来源时，$retainKeys 删除工作负载中原有的来源，否则合并后 configMap 和 secret 同时存在
+	assert.JSONEq(t, `[
+  {"name": "config", "configMap": {"name": "hello-config"}, "$retainKeys": ["configMap", "name"]}
+]`, volumes("prod"))
+	assert.JSONEq(t, `[
+  {"name": "config", "secret": {"secretName": "hello-config"}, "$retainKeys": ["name", "secret"]}
+]`, volumes("test"))
+}
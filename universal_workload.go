@@ -75,6 +75,30 @@ type UniversalWorkload struct {
 	}
 }
 
+// Kind 返回工作负载的 Kubernetes 资源类型，比如 Deployment
+func (w UniversalWorkload) Kind() string {
+	switch w.Type {
+	case "deployment", "deploy":
+		return "Deployment"
+	case "statefulset", "sts":
+		return "StatefulSet"
+	case "daemonset", "ds":
+		return "DaemonSet"
+	case "cronjob":
+		return "CronJob"
+	}
+	return ""
+}
+
+// Scalable 工作负载是否有 spec.replicas 字段
+func (w UniversalWorkload) Scalable() bool {
+	switch w.Kind() {
+	case "Deployment", "StatefulSet":
+		return true
+	}
+	return false
+}
+
 func (w UniversalWorkload) String() string {
 	sb := &strings.Builder{}
 	sb.WriteString(w.Cluster)
@@ -92,6 +116,17 @@ func (w UniversalWorkload) String() string {
 	return sb.String()
 }
 
+func (w *UniversalWorkload) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return
+	}
+	if err = w.Set(s); err != nil {
+		return
+	}
+	return
+}
+
 func (w *UniversalWorkload) Set(s string) error {
 	labelSplits := strings.Split(s, "?")
 	if len(labelSplits) == 2 {